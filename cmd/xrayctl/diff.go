@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+	"github.com/zionnode/xray-admin/internal/store"
+	"github.com/zionnode/xray-admin/internal/syncer"
+)
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	dbPath := fs.String("db", "data/users.vless.json", "本地清单文件（如 data/users.vless.json）")
+	proto := fs.String("proto", "", "清单对应的协议：vless | vmess（为空时按 -db 文件名推断）")
+	apiURL := fs.String("api", "http://127.0.0.1:8080/apiv2/nodes/server-clients/", "远端 API URL")
+	token := fs.String("token", "", "固定鉴权 token（优先于 -token-file 与环境变量 "+remote.TokenEnv+"）")
+	tokenFile := fs.String("token-file", "", "从文件读取 token")
+	publicID := fs.String("public-id", "", "Xray 服务器的 public_id（必填）")
+	proxy := fs.String("proxy", "", "访问远端 API 的 HTTP 代理")
+	apiCert := fs.String("api-cert", "", "访问远端 API 的客户端证书（PEM，mTLS）")
+	apiKey := fs.String("api-key", "", "客户端证书私钥（PEM）")
+	apiCA := fs.String("api-ca", "", "远端 API 的 CA bundle（PEM）")
+	mode := fs.String("mode", "replace", "同步模式：replace | upsert")
+	level := fs.Uint("level", 1, "默认 level（与 xraysync 保持一致）")
+	flow := fs.String("flow", "", "默认 VLESS flow（与 xraysync 保持一致）")
+	planLevels := fs.String("plan-levels", "", "按 plan 指定 level（与 xraysync 保持一致）")
+	flowMap := fs.String("flow-map", "", "按 tag 指定 VLESS flow（与 xraysync 保持一致）")
+	normEmail := fs.Bool("normalize-email", false, "email 去首尾空白并转小写（与 xraysync 保持一致）")
+	deriveUUID := fs.Bool("derive-uuid", false, "缺 id 时由 email 派生 UUIDv5（与 xraysync 保持一致）")
+	identity := fs.String("identity", "email", "Xray 中的用户标识：email | uuid（与 xraysync 保持一致）")
+	var onlyTags, excludeTags stringList
+	fs.Var(&onlyTags, "only-tags", "只管理这些 inbound tag（与 xraysync 保持一致）")
+	fs.Var(&excludeTags, "exclude-tags", "不管理这些 inbound tag（与 xraysync 保持一致）")
+	allowEmpty := fs.Bool("allow-empty", false, "远端 0 个 client 但有 tag 时照常预览（与 xraysync 保持一致）")
+	strictRemote := fs.Bool("strict-remote", false, "远端响应未通过结构检查时放弃（与 xraysync 保持一致）")
+	strictDup := fs.Bool("strict-dup", false, "远端有同 email 不同 id 时放弃（与 xraysync 保持一致）")
+	asJSON := fs.Bool("json", false, "以 JSON 输出")
+	_ = fs.Parse(args)
+
+	if *publicID == "" {
+		return errors.New("缺少必要参数：-public-id")
+	}
+	p := strings.ToLower(*proto)
+	if p == "" {
+		switch {
+		case strings.Contains(*dbPath, ".vless"):
+			p = "vless"
+		case strings.Contains(*dbPath, ".vmess"):
+			p = "vmess"
+		default:
+			return errors.New("无法从 -db 推断协议，请指定 -proto")
+		}
+	}
+	if p != "vless" && p != "vmess" {
+		return fmt.Errorf("%w: %q", syncer.ErrUnsupportedProto, p)
+	}
+	flows, err := syncer.ParseFlowMap(*flowMap)
+	if err != nil {
+		return err
+	}
+	ident, err := syncer.ParseIdentity(*identity)
+	if err != nil {
+		return err
+	}
+	levels, err := syncer.ParsePlanLevels(*planLevels)
+	if err != nil {
+		return err
+	}
+	tok, err := remote.ResolveToken(*token, *tokenFile, remote.TokenEnv)
+	if err != nil {
+		return err
+	}
+
+	db, err := store.Open(*dbPath)
+	if err != nil {
+		return err
+	}
+	have, err := db.Load()
+	if err != nil {
+		return err
+	}
+	hc, err := remote.NewHTTPClient(15*time.Second, *proxy)
+	if err != nil {
+		return err
+	}
+	if err := remote.ConfigureTLS(hc, remote.TLSFiles{CertFile: *apiCert, KeyFile: *apiKey, CAFile: *apiCA}); err != nil {
+		return err
+	}
+	res, err := remote.FetchWith(hc, *apiURL, tok, *publicID, remote.FetchOptions{})
+	if err != nil {
+		return err
+	}
+	// 与 xraysync 走同一条流水线（含保护检查）：xraysync 会放弃的轮次，这里也不给出计划
+	cfg := syncer.Config{
+		PublicID:       *publicID,
+		DefaultLevel:   uint32(*level),
+		DefaultFlow:    *flow,
+		FlowMap:        flows,
+		PlanLevels:     levels,
+		NormalizeEmail: *normEmail,
+		Identity:       ident,
+		DeriveUUID:     *deriveUUID,
+		OnlyTags:       onlyTags,
+		ExcludeTags:    excludeTags,
+		AllowEmpty:     *allowEmpty,
+		StrictRemote:   *strictRemote,
+		StrictDup:      *strictDup,
+	}
+	tags := syncer.EffectiveTags(cfg, res, p)
+	want, err := syncer.Target(cfg, res, p)
+	if errors.Is(err, syncer.ErrNoRemoteTags) {
+		fmt.Printf("proto=%s: no remote tags; xraysync leaves this proto untouched\n", p)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("xraysync would skip this cycle: %w", err)
+	}
+	plan := syncer.Diff(have, want, *mode)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+	for _, u := range plan.Adds {
+		fmt.Printf("+ %s uid=%s\n", u.Email, u.UID)
+	}
+	for _, u := range plan.Updates {
+		fmt.Printf("~ %s uid=%s\n", u.Email, u.UID)
+	}
+	for _, u := range plan.Removes {
+		fmt.Printf("- %s uid=%s\n", u.Email, u.UID)
+	}
+	fmt.Printf("proto=%s tags=%v adds=%d updates=%d removes=%d\n", p, tags, len(plan.Adds), len(plan.Updates), len(plan.Removes))
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/store"
+	"github.com/zionnode/xray-admin/internal/xray"
+)
+
+func runFlush(args []string) error {
+	fs := flag.NewFlagSet("flush", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:10085", "Xray API 地址（host:port 或 unix:///path/to/xray.sock）")
+	tags := fs.String("tags", "", "要清空的 inbound tag，逗号分隔（必填）")
+	var dbs stringList
+	fs.Var(&dbs, "db", "候选用户来源：本地清单文件（可重复或逗号分隔，如 data/users.vless.json）")
+	useStats := fs.Bool("stats", true, "同时把 Xray 流量统计里出现过的 email 作为候选（需开启 stats）")
+	yes := fs.Bool("yes", false, "确认执行（不加则只打印将要删除的候选数）")
+	timeout := fs.Duration("timeout", 5*time.Second, "拨号与单次 RPC 超时")
+	_ = fs.Parse(args)
+
+	var tagList []string
+	for _, t := range strings.Split(*tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tagList = append(tagList, t)
+		}
+	}
+	if len(tagList) == 0 {
+		return errors.New("缺少必要参数：-tags")
+	}
+
+	cli, err := xray.NewClient(*addr, tagList, *timeout, xray.DialOptions{})
+	if err != nil {
+		return fmt.Errorf("dial %s failed: %w", *addr, err)
+	}
+	defer cli.Close()
+
+	// Xray API 不能列出 inbound 里的用户：候选 = 本地清单 ∪ 流量统计
+	set := make(map[string]bool)
+	for _, path := range dbs {
+		db, err := store.Open(path)
+		if err != nil {
+			return err
+		}
+		users, _ := db.Load()
+		for _, u := range users {
+			set[u.Email] = true
+		}
+	}
+	if *useStats {
+		traffic, err := cli.UserTraffic()
+		if err != nil {
+			return fmt.Errorf("query stats failed (use -stats=false to skip): %w", err)
+		}
+		for email := range traffic {
+			set[email] = true
+		}
+	}
+	emails := make([]string, 0, len(set))
+	for email := range set {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	if !*yes {
+		fmt.Printf("would remove up to %d user(s) from tags %v; re-run with -yes to proceed\n", len(emails), tagList)
+		return nil
+	}
+
+	var failed int
+	for _, tag := range tagList {
+		n, err := cli.RemoveAll(tag, emails)
+		fmt.Printf("%-20s removed=%d\n", tag, n)
+		if err != nil {
+			var te xray.TagErrors
+			if errors.As(err, &te) {
+				failed += len(te)
+			}
+			fmt.Printf("%-20s errors: %v\n", tag, err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d removal(s) failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 子命令：xrayctl <cmd> [flags]
+var commands = map[string]struct {
+	run  func(args []string) error
+	help string
+}{
+	"diff":       {runDiff, "拉取远端清单并与本地清单对比，打印将要新增/更新/删除的用户（不连 Xray）"},
+	"flush":      {runFlush, "从指定 tag 删除所有已知用户（节点下线用；需 -yes）"},
+	"ping":       {runPing, "检查 Xray API 连接与各 inbound tag 是否可用"},
+	"snapdiff":   {runSnapdiff, "对比两个快照，列出新增/删除/变更的 client"},
+	"snapverify": {runSnapverify, "校验快照目录里每个快照的 sha256（发现篡改或截断）"},
+	"sub":        {runSub, "按清单里的用户生成 vless:// / vmess:// 分享链接"},
+}
+
+// stringList 是可重复的字符串 flag（也接受逗号分隔）
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: xrayctl <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].help)
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	c, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := c.run(os.Args[2:]); err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
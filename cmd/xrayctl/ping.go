@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/xray"
+)
+
+func runPing(args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:10085", "Xray API 地址（host:port 或 unix:///path/to/xray.sock）")
+	tags := fs.String("tags", "", "要检查的 inbound tag，逗号分隔（为空时只检查 API 连通性）")
+	timeout := fs.Duration("timeout", 5*time.Second, "拨号与单次 RPC 超时")
+	_ = fs.Parse(args)
+
+	var tagList []string
+	for _, t := range strings.Split(*tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tagList = append(tagList, t)
+		}
+	}
+
+	cli, err := xray.NewClient(*addr, tagList, *timeout, xray.DialOptions{})
+	if err != nil {
+		return fmt.Errorf("dial %s failed: %w", *addr, err)
+	}
+	defer cli.Close()
+
+	if len(tagList) == 0 {
+		if err := cli.Ping(context.Background()); err != nil {
+			return err
+		}
+		fmt.Printf("OK       %s\n", *addr)
+		return nil
+	}
+
+	res := cli.Probe()
+	bad := 0
+	for _, tag := range tagList {
+		switch err := res[tag]; {
+		case err == nil:
+			fmt.Printf("OK       %s\n", tag)
+		case errors.Is(err, xray.ErrUnknownTag):
+			bad++
+			fmt.Printf("UNKNOWN  %s: %v\n", tag, err)
+		default:
+			bad++
+			fmt.Printf("FAIL     %s: %v\n", tag, err)
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d/%d tag(s) unreachable or unknown", bad, len(tagList))
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+)
+
+type clientChange struct {
+	Email  string            `json:"email"`
+	Before remote.ClientLite `json:"before"`
+	After  remote.ClientLite `json:"after"`
+}
+
+type snapDiff struct {
+	Added   []remote.ClientLite `json:"added"`
+	Removed []remote.ClientLite `json:"removed"`
+	Changed []clientChange      `json:"changed"`
+}
+
+func runSnapdiff(args []string) error {
+	fs := flag.NewFlagSet("snapdiff", flag.ExitOnError)
+	a := fs.String("a", "", "旧快照（.json 或 .json.gz）")
+	b := fs.String("b", "", "新快照（.json 或 .json.gz）")
+	asJSON := fs.Bool("json", false, "以 JSON 输出")
+	_ = fs.Parse(args)
+	if *a == "" || *b == "" {
+		return errors.New("缺少必要参数：-a / -b")
+	}
+
+	ra, err := remote.ReadFile(*a, false)
+	if err != nil {
+		return err
+	}
+	rb, err := remote.ReadFile(*b, false)
+	if err != nil {
+		return err
+	}
+	d := diffClients(ra.Clients, rb.Clients)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	for _, c := range d.Added {
+		fmt.Printf("+ %s id=%s\n", c.Email, c.ID)
+	}
+	for _, c := range d.Removed {
+		fmt.Printf("- %s id=%s\n", c.Email, c.ID)
+	}
+	for _, c := range d.Changed {
+		before, _ := json.Marshal(c.Before)
+		after, _ := json.Marshal(c.After)
+		fmt.Printf("~ %s %s -> %s\n", c.Email, before, after)
+	}
+	fmt.Printf("added=%d removed=%d changed=%d\n", len(d.Added), len(d.Removed), len(d.Changed))
+	return nil
+}
+
+// diffClients 以 email 为键对比两份 client 列表，结果按 email 排序
+func diffClients(a, b []remote.ClientLite) snapDiff {
+	before := make(map[string]remote.ClientLite, len(a))
+	for _, c := range a {
+		before[c.Email] = c
+	}
+	after := make(map[string]remote.ClientLite, len(b))
+	for _, c := range b {
+		after[c.Email] = c
+	}
+
+	var d snapDiff
+	for email, c := range after {
+		old, ok := before[email]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, c)
+		case !reflect.DeepEqual(old, c):
+			d.Changed = append(d.Changed, clientChange{Email: email, Before: old, After: c})
+		}
+	}
+	for email, c := range before {
+		if _, ok := after[email]; !ok {
+			d.Removed = append(d.Removed, c)
+		}
+	}
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Email < d.Added[j].Email })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Email < d.Removed[j].Email })
+	sort.Slice(d.Changed, func(i, j int) bool { return d.Changed[i].Email < d.Changed[j].Email })
+	return d
+}
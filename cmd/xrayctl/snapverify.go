@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/zionnode/xray-admin/internal/syncer"
+)
+
+func runSnapverify(args []string) error {
+	fs := flag.NewFlagSet("snapverify", flag.ExitOnError)
+	dir := fs.String("dir", "data/snapshots", "快照目录")
+	requireSum := fs.Bool("require", false, "缺少 .sha256 的快照也算失败（默认只提示）")
+	_ = fs.Parse(args)
+
+	ents, err := os.ReadDir(*dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range ents {
+		if n := e.Name(); !e.IsDir() && (strings.HasSuffix(n, ".json") || strings.HasSuffix(n, ".json.gz")) {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	ok, bad, nosum := 0, 0, 0
+	for _, n := range names {
+		switch err := syncer.VerifySnapshot(filepath.Join(*dir, n)); {
+		case err == nil:
+			ok++
+		case errors.Is(err, syncer.ErrNoChecksum):
+			nosum++
+			fmt.Printf("NOSUM     %s\n", n)
+		default:
+			bad++
+			fmt.Printf("MISMATCH  %s: %v\n", n, err)
+		}
+	}
+	fmt.Printf("ok=%d mismatch=%d nosum=%d\n", ok, bad, nosum)
+	if *requireSum {
+		bad += nosum
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d snapshot(s) failed verification", bad)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/zionnode/xray-admin/internal/store"
+	"github.com/zionnode/xray-admin/internal/syncer"
+)
+
+// shareTemplate 是分享链接里与服务器/传输相关的部分（清单里只有用户自身的字段）
+type shareTemplate struct {
+	host, port  string
+	network     string // tcp | ws | grpc | ...
+	security    string // none | tls | reality
+	sni, path   string
+	fingerprint string
+	publicKey   string // reality pbk
+	shortID     string // reality sid
+	remark      string
+	tag         string // inbound tag（按 tag 的 flow 以它为准）
+}
+
+func runSub(args []string) error {
+	fs := flag.NewFlagSet("sub", flag.ExitOnError)
+	dbPath := fs.String("db", "data/users.vless.json", "本地清单文件（如 data/users.vless.json）")
+	email := fs.String("email", "", "用户 email（必填）")
+	host := fs.String("host", "", "服务器地址（必填）")
+	port := fs.Int("port", 443, "服务器端口")
+	network := fs.String("net", "tcp", "传输方式：tcp | ws | grpc ...")
+	security := fs.String("security", "tls", "传输安全：none | tls | reality")
+	sni := fs.String("sni", "", "TLS/REALITY SNI（为空时用 -host）")
+	path := fs.String("path", "", "ws path 或 grpc serviceName")
+	fp := fs.String("fp", "", "TLS 指纹（如 chrome）")
+	pbk := fs.String("pbk", "", "REALITY 公钥")
+	sid := fs.String("sid", "", "REALITY shortId")
+	remark := fs.String("remark", "", "链接备注（为空时用 email）")
+	tag := fs.String("tag", "", "链接对应的 inbound tag（用户有按 tag 的 flow 时据此选择；为空用默认 flow）")
+	_ = fs.Parse(args)
+	if *email == "" || *host == "" {
+		return errors.New("缺少必要参数：-email / -host")
+	}
+
+	db, err := store.Open(*dbPath)
+	if err != nil {
+		return err
+	}
+	users, err := db.Load()
+	if err != nil {
+		return err
+	}
+	var (
+		u     store.User
+		found bool
+	)
+	for _, cand := range users {
+		if cand.Email == *email {
+			u, found = cand, true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("email %s not found in %s", *email, *dbPath)
+	}
+
+	t := shareTemplate{
+		host: *host, port: strconv.Itoa(*port),
+		network: *network, security: *security,
+		sni: *sni, path: *path, fingerprint: *fp,
+		publicKey: *pbk, shortID: *sid, remark: *remark,
+		tag: *tag,
+	}
+	if t.sni == "" && *security != "none" {
+		t.sni = *host
+	}
+	if t.remark == "" {
+		t.remark = u.Email
+	}
+
+	link, err := shareLink(u, t)
+	if err != nil {
+		return err
+	}
+	fmt.Println(link)
+	return nil
+}
+
+// shareLink 生成 vless:// 或 vmess:// 分享链接
+func shareLink(u store.User, t shareTemplate) (string, error) {
+	switch u.Proto {
+	case "vless":
+		q := url.Values{}
+		enc := u.Encryption
+		if enc == "" {
+			enc = "none"
+		}
+		q.Set("encryption", enc)
+		q.Set("type", t.network)
+		q.Set("security", t.security)
+		if flow := u.FlowFor(t.tag); flow != "" {
+			q.Set("flow", flow)
+		}
+		if t.sni != "" {
+			q.Set("sni", t.sni)
+		}
+		if t.fingerprint != "" {
+			q.Set("fp", t.fingerprint)
+		}
+		if t.publicKey != "" {
+			q.Set("pbk", t.publicKey)
+		}
+		if t.shortID != "" {
+			q.Set("sid", t.shortID)
+		}
+		if t.path != "" {
+			if t.network == "grpc" {
+				q.Set("serviceName", t.path)
+			} else {
+				q.Set("path", t.path)
+			}
+		}
+		link := url.URL{
+			Scheme:   "vless",
+			User:     url.User(u.UUID),
+			Host:     net.JoinHostPort(t.host, t.port),
+			RawQuery: q.Encode(),
+			Fragment: t.remark,
+		}
+		return link.String(), nil
+
+	case "vmess":
+		// v2rayN 约定的 base64(JSON) 格式
+		scy := u.Security
+		if scy == "" {
+			scy = "auto"
+		}
+		tls := ""
+		if t.security == "tls" {
+			tls = "tls"
+		}
+		b, err := json.Marshal(map[string]string{
+			"v":    "2",
+			"ps":   t.remark,
+			"add":  t.host,
+			"port": t.port,
+			"id":   u.UUID,
+			"aid":  strconv.FormatUint(uint64(u.AlterID), 10),
+			"scy":  scy,
+			"net":  t.network,
+			"type": "none",
+			"path": t.path,
+			"tls":  tls,
+			"sni":  t.sni,
+			"fp":   t.fingerprint,
+		})
+		if err != nil {
+			return "", err
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(b), nil
+	}
+	return "", fmt.Errorf("%w: %q", syncer.ErrUnsupportedProto, u.Proto)
+}
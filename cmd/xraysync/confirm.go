@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/zionnode/xray-admin/internal/store"
+)
+
+// confirmPreview 是确认提示里最多列出的 email 数
+const confirmPreview = 20
+
+// newConfirmer 返回 SyncOptions.ConfirmRemovals：列出删除数与前几个 email，要求在 in 上输入 "yes"。
+// 各协议的 Sync 并发运行，提示逐个进行；in 读到 EOF（如非交互环境）视为拒绝。
+func newConfirmer(in io.Reader, out io.Writer) func(tags []string, dels []store.User) bool {
+	var mu sync.Mutex
+	r := bufio.NewReader(in)
+	return func(tags []string, dels []store.User) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		proto := dels[0].Proto
+		fmt.Fprintf(out, "\n%s tags=%v: %d user(s) will be REMOVED from Xray:\n", strings.ToUpper(proto), tags, len(dels))
+		for i, u := range dels {
+			if i == confirmPreview {
+				fmt.Fprintf(out, "  ... and %d more\n", len(dels)-confirmPreview)
+				break
+			}
+			fmt.Fprintf(out, "  %s (uid=%s)\n", u.Email, u.UID)
+		}
+		fmt.Fprint(out, `type "yes" to continue: `)
+		line, _ := r.ReadString('\n')
+		return strings.TrimSpace(line) == "yes"
+	}
+}
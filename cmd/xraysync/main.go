@@ -1,43 +1,134 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"math/rand"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/zionnode/xray-admin/internal/notify"
 	"github.com/zionnode/xray-admin/internal/remote"
 	"github.com/zionnode/xray-admin/internal/store"
 	"github.com/zionnode/xray-admin/internal/syncer"
+	"github.com/zionnode/xray-admin/internal/xray"
+
+	"google.golang.org/grpc/keepalive"
 )
 
 func main() {
 	// 远端 API
 	apiURL := flag.String("api", "http://127.0.0.1:8080/apiv2/nodes/server-clients/", "远端 API URL")
-	token := flag.String("token", "", "固定鉴权 token（必填）")
-	publicID := flag.String("public-id", "", "该 Xray 服务器的 public_id（必填）")
+	token := flag.String("token", "", "固定鉴权 token（优先于 -token-file 与环境变量 "+remote.TokenEnv+"）")
+	tokenFile := flag.String("token-file", "", "从文件读取 token（内容会去掉首尾空白）")
+	apiCert := flag.String("api-cert", "", "访问远端 API 的客户端证书（PEM，mTLS；需同时给 -api-key）")
+	apiKey := flag.String("api-key", "", "客户端证书私钥（PEM）")
+	apiCA := flag.String("api-ca", "", "校验远端 API 服务端证书的 CA bundle（PEM；为空用系统根证书）")
+	fromFile := flag.String("from-file", "", "不请求远端，改为读取该快照文件（.json 或 .json.gz）重放一次同步；不写快照与状态，无需 token")
+	subscribeURL := flag.String("subscribe", "", "远端 WebSocket 推送地址（ws:// 或 wss://）：收到推送即同步该 public_id，不必等 -interval；需同时给 -interval，连接断开时靠轮询兜底并自动重连；沿用 -proxy 与 -api-cert/-api-key/-api-ca")
+	proxy := flag.String("proxy", "", "访问远端 API 的 HTTP 代理（如 http://proxy:3128；为空则读 HTTP_PROXY/HTTPS_PROXY）")
+	var publicIDs stringList
+	flag.Var(&publicIDs, "public-id", "该 Xray 服务器的 public_id（必填；可重复或逗号分隔，多个时各自独立同步，DB/快照/状态按 public_id 分开）")
 
 	// Xray gRPC 与默认
-	xrayAddr := flag.String("xray", "127.0.0.1:1090", "Xray gRPC 地址（host:port）")
+	xrayAddr := flag.String("xray", "127.0.0.1:1090", "Xray gRPC 地址（host:port，或 unix:///path/to/api.sock）；逗号分隔多个时把同一份用户集下发到每个端点")
 	defLevel := flag.Uint("level", 1, "默认 level（建议 1）")
 	defFlow := flag.String("flow", "", "默认 VLESS flow（普通 VLESS 留空；Vision 用 xtls-rprx-vision）")
+	planLevels := flag.String("plan-levels", "", "按远端 plan 字段指定 level，如 \"basic=0,pro=1\"（远端给了 level 时以远端为准；都没有时用 -level）")
+	flowMap := flag.String("flow-map", "", "按 tag 指定 VLESS flow，如 \"reality-in=xtls-rprx-vision,ws-in=\"（优先于 -flow 与远端按用户给出的 flow）")
 
 	// 同步模式与存储
+	only := flag.String("only", "", "只同步这些协议（逗号分隔：vless,vmess；为空则同步所有有 tag 的协议）")
+	var onlyTags, excludeTags stringList
+	flag.Var(&onlyTags, "only-tags", "只管理这些 inbound tag（可重复或逗号分隔；为空表示远端给出的全部）")
+	flag.Var(&excludeTags, "exclude-tags", "不管理这些 inbound tag（可重复或逗号分隔；如归其他控制器管理的 inbound）")
+	confirm := flag.Bool("confirm", false, "单次模式：有计划删除时先列出删除数与前 20 个 email，在 stdin 输入 yes 才执行（否则放弃该协议本轮、不写盘）")
+	assumeYes := flag.Bool("yes", false, "配合 -confirm：不提示，直接视为确认（供自动化脚本）")
+	maxRemovals := flag.String("max-removals", "", "单轮最多删除多少用户（如 500 或 10%，占本地清单比例）；超出则放弃本轮且不写盘（为空不限制）")
+	requireTags := flag.Bool("require-remote-tags", false, "启用的协议（见 -only）远端没给 tag 时记为该协议失败（默认只记日志并跳过该协议）")
+	removeGrace := flag.Duration("remove-grace", 0, "replace 模式下用户从远端消失后先保留，连续缺席满该时长才删除（如 10m；0 表示立即删除）")
+	strictTags := flag.Bool("strict-tags", false, "远端给出的 tag 在 Xray 上不存在时放弃本轮（默认剔除该 tag 并告警）")
+	strictRemote := flag.Bool("strict-remote", false, "远端响应缺 tags/clients 字段、二者皆空或 client 缺 id/email 时放弃本轮（默认仅告警）")
+	allowEmpty := flag.Bool("allow-empty", false, "允许远端返回 0 个 client 但有 tag 时照常同步（默认视为上游异常，跳过本轮）")
 	mode := flag.String("mode", "replace", "同步模式：replace | upsert（replace 会删除目标外的用户）")
-	dbPath := flag.String("db", "data/users.json", "本地清单 DB 路径（基名；会自动拆分为 .vless/.vmess）")
-	snapDir := flag.String("snap", "data/snapshots", "快照目录（保存远端原始 JSON）")
+	dbPath := flag.String("db", "data/users.json", "本地清单 DB 路径（基名；会自动拆分为 .vless/.vmess；为空则只在内存中保存）")
+	dbBackups := flag.Int("db-backups", 0, "每次写清单前保留旧文件的备份份数（<db>.bak、<db>.bak.1 …；0 表示不备份）")
+	snapDir := flag.String("snap", "data/snapshots", "快照目录（保存远端原始 JSON；为空等同 -no-snapshots）")
+	noSnap := flag.Bool("no-snapshots", false, "不写任何快照（只读或内存紧张的节点；同时不再在内存里保留远端原始响应）")
+	incremental := flag.Bool("incremental", false, "增量拉取：请求带上次成功拉取的时间 since，增量结果只做 upsert（不删除）")
+	fullResync := flag.Duration("full-resync-interval", time.Hour, "-incremental 时每隔多久做一次全量 replace 同步（<=0 表示只在启动时全量）")
+	statePath := flag.String("state", "", "状态文件：记录上次成功同步的远端 revision 与结果；启动时远端未变化则跳过首轮同步（为空关闭）")
+	snapKeep := flag.Int("snap-keep", 0, "只保留最新 N 份快照（0 表示不清理）")
+	snapGzip := flag.Duration("snap-gzip-after", 0, "早于该时长的快照 gzip 归档（如 24h；0 表示不压缩）")
 
 	// 运行控制
+	statusAddr := flag.String("status-addr", "", "HTTP 状态监听地址（如 :8091），提供 /healthz 与 /status（为空关闭）")
 	interval := flag.Duration("interval", 0, "轮询间隔（>0 则循环同步，如 1m）")
+	grpcMaxMsg := flag.Int("grpc-max-msg", 0, "与 Xray 通信时单条 gRPC 响应的最大字节数（0 用默认 4MB；用户很多且开启 -enforce-quota 时调大）")
+	kaTime := flag.Duration("grpc-keepalive", 0, "与 Xray 的 gRPC 连接空闲时每隔多久 ping 一次（如 5m；0 关闭）。配合 -keep-conn 及早发现被 NAT/防火墙丢弃的连接；Xray 默认不接受 5m 以内的 ping，过频会被断开")
+	kaTimeout := flag.Duration("grpc-keepalive-timeout", 20*time.Second, "keepalive ping 多久没有回应即断开连接（随后自动重连）")
+	kaIdle := flag.Bool("grpc-keepalive-idle", true, "没有进行中的调用时也发 keepalive ping（轮询间隔之间的空闲期正需要它）")
+	keepConn := flag.Bool("keep-conn", false, "常驻模式下跨轮复用与 Xray 的 gRPC 连接（断线由 gRPC 自动重连），省掉每轮的拨号握手")
+	jitter := flag.Float64("interval-jitter", 0, "每轮间隔的随机抖动比例（如 0.1 表示 ±10%），避免大量节点同时请求远端（0 表示不抖动）")
+	syncTimeout := flag.Duration("sync-timeout", 0, "单次 Sync（每个协议）最长耗时，超时中止本轮、不写清单（如 50s；0 表示不限）")
 	concurrency := flag.Int("concurrency", 64, "并发 worker 数（Add/Update/Delete）")
+	concAuto := flag.Bool("concurrency-auto", false, "自适应并发：从 4 起步，无错误时逐步加到 -concurrency，遇到 Unavailable/ResourceExhausted/超时减半")
+	concAdd := flag.Int("concurrency-add", 0, "Add（含更新的加回）并发上限（0 沿用 -concurrency）")
+	concDel := flag.Int("concurrency-del", 0, "Remove（含更新的删除）并发上限（0 沿用 -concurrency）")
+	enforceQuota := flag.Bool("enforce-quota", false, "按远端 quota 检查 Xray 用户流量统计，超额用户移出 inbound（需 Xray 开启 stats）")
+	rate := flag.Float64("rate", 0, "每个 Xray 端点每秒最多承受的 gRPC 调用数（VLESS 与 VMess 合计，每个 tag 计一次；0 表示不限）")
+	atomicAdd := flag.Bool("atomic-add", false, "多 tag 添加全成或全不成：任一 tag 失败时从已成功的 tag 撤回该用户（计一次失败）")
 	reseed := flag.Bool("reseed", false, "自愈模式：对目标集合执行 Add（已存在跳过），修复 Xray 内存态丢失")
+	summaryJSON := flag.Bool("summary-json", false, "每轮结束后向 stdout 输出一行 JSON 汇总（各 public_id/协议的计数、tags、错误），便于 CI 解析")
+	maxFailures := flag.Int("max-failures", syncer.DefaultMaxFailures, "每个协议在汇总/webhook/报告中最多保留多少条失败明细（op、email、tag、gRPC code；多 tag 操作按 tag 各计一条；<0 不保留）")
+	reportPath := flag.String("report", "", "每轮结束后把完整结果（各协议计数、新增/更新/删除的 email、失败明细与 gRPC code）写入该 JSON 文件（每轮覆盖；为空不写）")
+	verbosity := flag.String("v", "normal", "日志量：quiet（只输出汇总、告警与失败）| normal | verbose（逐个输出成功的用户操作）")
+	printCfg := flag.Bool("print-config", false, "打印解析后的有效配置（各 flag 取值、token 来源、代理环境变量、各 public_id 的 DB/快照/状态路径；token 打码）后退出")
+	logFormat := flag.String("log-format", "text", "日志格式：text | json（json 便于 Loki 等采集）")
+	identity := flag.String("identity", "email", "Xray 中的用户标识：email | uuid（inbound 以 UUID 作为 email 开通时用 uuid；add 与 remove 都使用它）")
+	normEmail := flag.Bool("normalize-email", false, "远端 email 去首尾空白并转小写后再同步（email 也是 Xray 的删除键：首次开启时大小写不同的已有用户会被删旧加新）")
+	deriveUUID := flag.Bool("derive-uuid", false, "远端 client 缺 id 时由 email 派生固定的 UUIDv5（URL 命名空间），同一 email 在所有节点上一致（默认忽略缺 id 的 client）")
+	strictDup := flag.Bool("strict-dup", false, "远端出现同 email 不同 id 的重复用户时放弃本轮同步（默认仅告警，保留最后一条）")
 	idemMode := flag.String("count-idempotent", "skip", "幂等结果计数：skip|success|fail（默认 skip，单独统计到 skipped）")
+	retries := flag.Int("retries", syncer.DefaultRetry.Attempts, "单个 Add/Remove 的最大尝试次数（含首次）")
+	retryBase := flag.Duration("retry-base", syncer.DefaultRetry.BaseDelay, "重试间隔基数（第 i 次重试等待 i*base）")
+	retryMax := flag.Duration("retry-max", syncer.DefaultRetry.Max, "单次重试等待上限")
+
+	// 通知
+	webhook := flag.String("webhook", "", "同步后 POST 结果的 webhook URL（为空则不通知）")
+	hookRemoved := flag.Int64("webhook-min-removed", 1, "removed 达到该值才通知（<=0 表示不按删除数触发）")
+	hookFailed := flag.Int64("webhook-min-failed", 1, "failed 达到该值才通知（<=0 表示不按失败数触发）")
 
 	flag.Parse()
-	if *token == "" || *publicID == "" {
-		log.Fatal("缺少必要参数：-token / -public-id")
+	switch *logFormat {
+	case "text":
+	case "json":
+		// 设为默认 handler 后，剩余的 log.Printf 也会以 {"msg": ...} 形式输出
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	default:
+		log.Fatalf("unknown -log-format %q (text|json)", *logFormat)
+	}
+	tok, err := remote.ResolveToken(*token, *tokenFile, remote.TokenEnv)
+	if err != nil {
+		log.Fatalf("token: %v", err)
+	}
+	if tok == "" && *fromFile == "" && !*printCfg {
+		log.Fatal("缺少 token：请通过 -token、-token-file 或环境变量 " + remote.TokenEnv + " 提供")
+	}
+	if len(publicIDs) == 0 {
+		log.Fatal("缺少必要参数：-public-id")
+	}
+	if *confirm && (*interval > 0 || *subscribeURL != "") {
+		log.Fatal("-confirm 只用于单次模式（不能与 -interval/-subscribe 同用）")
+	}
+	if *subscribeURL != "" && *interval <= 0 {
+		log.Fatal("-subscribe 需要同时给 -interval（推送断开期间靠轮询兜底）")
 	}
 
 	// helper：从基路径派生 .vless/.vmess 两个文件
@@ -47,123 +138,401 @@ func main() {
 		}
 		return base + "." + suffix + ".json"
 	}
-	dbPathV := suff(*dbPath, "vless")
-	dbPathM := suff(*dbPath, "vmess")
+	onlySet, err := parseOnly(*only)
+	if err != nil {
+		log.Fatalf("-only: %v", err)
+	}
+	var onlyList []string
+	for p := range onlySet {
+		onlyList = append(onlyList, p)
+	}
 
-	// 打开两个 DB（分别记录两套权威清单，互不覆盖）
-	dbV, err := store.Open(dbPathV)
+	removalLimit, err := syncer.ParseRemovalLimit(*maxRemovals)
+	if err != nil {
+		log.Fatalf("-max-removals: %v", err)
+	}
+	flows, err := syncer.ParseFlowMap(*flowMap)
 	if err != nil {
-		log.Fatalf("open db vless: %v", err)
+		log.Fatalf("-flow-map: %v", err)
+	}
+	ident, err := syncer.ParseIdentity(*identity)
+	if err != nil {
+		log.Fatalf("-identity: %v", err)
+	}
+	levels, err := syncer.ParsePlanLevels(*planLevels)
+	if err != nil {
+		log.Fatalf("-plan-levels: %v", err)
+	}
+	verb, err := syncer.ParseVerbosity(*verbosity)
+	if err != nil {
+		log.Fatalf("-v: %v", err)
+	}
+
+	opts := syncer.SyncOptions{
+		Retry:           syncer.RetryPolicy{Attempts: *retries, BaseDelay: *retryBase, Max: *retryMax},
+		SnapKeep:        *snapKeep,
+		SnapGzipAfter:   *snapGzip,
+		EnforceQuota:    *enforceQuota,
+		MaxRemovals:     removalLimit,
+		AtomicAdd:       *atomicAdd,
+		Rate:            *rate,
+		AutoConcurrency: *concAuto,
+		Timeout:         *syncTimeout,
+		RemoveGrace:     *removeGrace,
+		RecordChanges:   *reportPath != "",
+		MaxFailures:     *maxFailures,
+		Verbosity:       verb,
+		Dial: xray.DialOptions{
+			MaxRecvMsgSize: *grpcMaxMsg,
+			Keepalive:      keepalive.ClientParameters{Time: *kaTime, Timeout: *kaTimeout, PermitWithoutStream: *kaIdle},
+		},
+
+		ConcurrencyAdd: *concAdd,
+		ConcurrencyDel: *concDel,
+	}
+
+	if *confirm && !*assumeYes {
+		opts.ConfirmRemovals = newConfirmer(os.Stdin, os.Stderr)
+	}
+
+	if *keepConn && *interval > 0 {
+		opts.Pool = xray.NewPool(15 * time.Second)
+		opts.Pool.Options = opts.Dial
+		defer opts.Pool.Close()
 	}
-	dbM, err := store.Open(dbPathM)
+
+	httpClient, err := remote.NewHTTPClient(15*time.Second, *proxy)
 	if err != nil {
-		log.Fatalf("open db vmess: %v", err)
+		log.Fatalf("-proxy: %v", err)
+	}
+	if err := remote.ConfigureTLS(httpClient, remote.TLSFiles{CertFile: *apiCert, KeyFile: *apiKey, CAFile: *apiCA}); err != nil {
+		log.Fatalf("-api-cert/-api-key/-api-ca: %v", err)
+	}
+
+	if *noSnap {
+		*snapDir = ""
 	}
 
-	buildUsers := func(clients []remote.ClientLite, proto string) map[string]store.User {
-		out := make(map[string]store.User, len(clients))
-		for _, c := range clients {
-			if c.Email == "" || c.ID == "" {
-				continue
+	// 每个 public_id 一套独立的 DB/快照/状态；只有一个时沿用原路径
+	servers := make([]*server, 0, len(publicIDs))
+	dbPaths := make(map[string][2]string, len(publicIDs)) // public_id → vless/vmess 清单路径（-print-config 用）
+	for _, pid := range publicIDs {
+		sv := &server{publicID: pid, snapDir: *snapDir, statePath: *statePath, firstRun: true}
+		base := *dbPath
+		if len(publicIDs) > 1 {
+			base = suff(base, pid)
+			if sv.snapDir != "" {
+				sv.snapDir = filepath.Join(sv.snapDir, pid)
 			}
-			u := store.User{
-				UID:   c.Email, // 以 email/UID 作为主键
-				Email: c.Email,
-				UUID:  c.ID,
-				Proto: proto,
-				Level: uint32(*defLevel),
-				Flow:  "",
+			if sv.statePath != "" {
+				sv.statePath = suff(sv.statePath, pid)
 			}
-			if proto == "vless" {
-				u.Flow = *defFlow // 仅 vless 有 flow 概念
+		}
+
+		if *dbPath != "" {
+			dbPaths[pid] = [2]string{suff(base, "vless"), suff(base, "vmess")}
+		}
+		if *printCfg {
+			servers = append(servers, sv) // 只打印路径，不打开 DB、不读状态
+			continue
+		}
+
+		// 打开两个 DB（分别记录两套权威清单，互不覆盖）；-db 为空时用内存库（重启即清空）
+		sv.dbV, sv.dbM = store.NewMemory(), store.NewMemory()
+		if *dbPath != "" {
+			sv.dbV = openDB(dbPaths[pid][0], pid)
+			sv.dbM = openDB(dbPaths[pid][1], pid)
+			sv.dbV.Backups, sv.dbM.Backups = *dbBackups, *dbBackups
+		}
+
+		// 启动时读一次状态：首轮若远端 revision 未变，直接跳过（重启不必全量重推）
+		if sv.statePath != "" {
+			if sv.startState, err = loadState(sv.statePath); err != nil {
+				log.Printf("warn: load state %s failed: %v", sv.statePath, err)
 			}
-			out[c.Email] = u
-		}
-		return out
-	}
-
-	runOnce := func() {
-		log.Printf("fetching %s ...", *apiURL)
-		res, err := remote.Fetch(*apiURL, *token, *publicID, 15*time.Second)
-		if err != nil {
-			log.Printf("fetch error: %v", err)
-			return
-		}
-		// 快速提示返回了什么 tags
-		log.Printf("remote tags: vless=%v vmess=%v (clients=%d)", res.TagsVLESS, res.TagsVMESS, len(res.Clients))
-
-		// VLESS 同步
-		if len(res.TagsVLESS) > 0 {
-			usersV := buildUsers(res.Clients, "vless")
-			log.Printf("sync VLESS → Xray(%s), tags=%v, users=%d, mode=%s, concurrency=%d, reseed=%v",
-				*xrayAddr, res.TagsVLESS, len(usersV), *mode, *concurrency, *reseed)
-
-			sum, err := syncer.Sync(
-				*xrayAddr,
-				res.TagsVLESS,
-				usersV,
-				*mode,
-				*concurrency,
-				*reseed,
-				*idemMode, // ← 幂等计数策略
-				dbV,
-				*snapDir,
-				res.Raw,
-			)
-			if err != nil {
-				log.Printf("sync VLESS error: %v", err)
-			} else {
-				log.Printf("SYNC VLESS DONE: added=%d updated=%d removed=%d failed=%d skipped=%d (add-exist=%d, del-miss=%d)",
-					sum.Added, sum.Updated, sum.Removed, sum.Failed,
-					sum.SkipAddExist+sum.SkipDelMissing, sum.SkipAddExist, sum.SkipDelMissing,
-				)
+			if sv.startState != nil {
+				sv.since, sv.fullAt = sv.startState.Since, sv.startState.FullAt
 			}
 		}
+		servers = append(servers, sv)
+	}
+
+	if *printCfg {
+		src := "none"
+		switch {
+		case tok == "":
+		case strings.TrimSpace(*token) != "":
+			src = "-token " + redact(tok)
+		case *tokenFile != "":
+			src = "-token-file " + *tokenFile + " " + redact(tok)
+		default:
+			src = "$" + remote.TokenEnv + " " + redact(tok)
+		}
+		printConfig(os.Stdout, src, servers, dbPaths)
+		return
+	}
+
+	// syncServer 同步一个 public_id；返回本轮是否失败（拉取失败、被保护逻辑跳过、或任一协议 Sync 报错）
+	// pushed 非 nil 时使用推送来的清单，不再拉取
+	syncServer := func(sv *server, pushed *remote.FetchResult) (results []notify.Result, tags map[string][]string, err error) {
+		cfg := syncer.Config{
+			APIURL:     *apiURL,
+			Token:      tok,
+			PublicID:   sv.publicID,
+			HTTPClient: httpClient,
+			FromFile:   *fromFile,
+			Pushed:     pushed,
+
+			XrayAddr:     *xrayAddr,
+			DefaultLevel: uint32(*defLevel),
+			DefaultFlow:  *defFlow,
+			FlowMap:      flows,
+			PlanLevels:   levels,
+
+			NormalizeEmail: *normEmail,
+			DeriveUUID:     *deriveUUID,
+			Identity:       ident,
+
+			Only:        onlyList,
+			OnlyTags:    onlyTags,
+			ExcludeTags: excludeTags,
+			Mode:        *mode,
+			Concurrency: *concurrency,
+			Reseed:      *reseed,
+			IdemMode:    *idemMode,
+
+			AllowEmpty:   *allowEmpty,
+			StrictDup:    *strictDup,
+			StrictRemote: *strictRemote,
+			StrictTags:   *strictTags,
+			RequireTags:  *requireTags,
 
-		// VMess 同步
-		if len(res.TagsVMESS) > 0 {
-			usersM := buildUsers(res.Clients, "vmess")
-			log.Printf("sync VMESS → Xray(%s), tags=%v, users=%d, mode=%s, concurrency=%d, reseed=%v",
-				*xrayAddr, res.TagsVMESS, len(usersM), *mode, *concurrency, *reseed)
-
-			sum, err := syncer.Sync(
-				*xrayAddr,
-				res.TagsVMESS,
-				usersM,
-				*mode,
-				*concurrency,
-				*reseed,
-				*idemMode, // ← 幂等计数策略
-				dbM,
-				*snapDir,
-				res.Raw,
-			)
-			if err != nil {
-				log.Printf("sync VMESS error: %v", err)
-			} else {
-				log.Printf("SYNC VMESS DONE: added=%d updated=%d removed=%d failed=%d skipped=%d (add-exist=%d, del-miss=%d)",
-					sum.Added, sum.Updated, sum.Removed, sum.Failed,
-					sum.SkipAddExist+sum.SkipDelMissing, sum.SkipAddExist, sum.SkipDelMissing,
-				)
+			DBV:     sv.dbV,
+			DBM:     sv.dbM,
+			SnapDir: sv.snapDir,
+			Options: opts,
+		}
+		if *incremental && pushed == nil && !sv.since.IsZero() && (*fullResync <= 0 || time.Since(sv.fullAt) < *fullResync) {
+			cfg.Since = sv.since
+		}
+		// 首轮若远端 revision 与上次成功时相同，直接跳过（重启不必全量重推）
+		if sv.firstRun && sv.startState != nil {
+			cfg.SkipRevision = sv.startState.Revision
+		}
+		sv.firstRun = false
+
+		fetchedAt := time.Now().UTC()
+		out, err := syncer.Run(cfg)
+		sv.runID = ""
+		if out == nil {
+			return nil, nil, err
+		}
+		sv.runID = out.RunID
+		tags = out.Tags
+		for _, r := range out.Results {
+			results = append(results, newResult(r.Proto, r.Tags, r.Summary, r.Err))
+		}
+
+		if *webhook != "" && shouldNotify(results, *hookRemoved, *hookFailed) {
+			payload := notify.Payload{Time: time.Now().UTC(), PublicID: sv.publicID, RunID: out.RunID, Results: results}
+			if err := notify.Post(*webhook, payload, 10*time.Second); err != nil {
+				log.Printf("warn: webhook failed: %v", err)
 			}
 		}
 
-		if len(res.TagsVLESS) == 0 && len(res.TagsVMESS) == 0 {
-			log.Printf("no tags in remote response; nothing to do")
+		// 只有整轮成功才推进 since（失败的增量下次会被重新拉到）并写状态；离线重放不动状态
+		if err != nil || out.Skipped || *fromFile != "" {
+			return results, tags, err
+		}
+		for _, r := range results {
+			if r.Summary != nil && r.Summary.Failed > 0 {
+				return results, tags, nil
+			}
+		}
+		sv.since = fetchedAt
+		if !out.Incremental {
+			sv.fullAt = fetchedAt
+		}
+		if sv.statePath != "" {
+			st := runState{Revision: out.Revision, Time: time.Now().UTC(), Results: results, Since: sv.since, FullAt: sv.fullAt}
+			if err := saveState(sv.statePath, st); err != nil {
+				log.Printf("warn: save state failed: %v", err)
+			}
+		}
+		return results, tags, nil
+	}
+
+	tracker := newStatusTracker(*interval)
+	if *statusAddr != "" {
+		go func() {
+			if err := tracker.serve(*statusAddr); err != nil {
+				log.Printf("warn: status server stopped: %v", err)
+			}
+		}()
+	}
+
+	// 同一时刻只允许一轮同步：上一轮还没跑完时跳过本次 tick（否则会并发写同一个 DB 文件）
+	var running sync.Mutex
+	// runCycle 同步 svs 并输出报告/汇总，返回是否有失败（任一 public_id 出错或任一协议 failed>0）；调用方持有 running
+	runCycle := func(svs []*server, pushed *remote.FetchResult) (failed bool) {
+		report := runReport{Time: time.Now().UTC()}
+		for _, sv := range svs {
+			results, tags, err := syncServer(sv, pushed)
+			tracker.record(sv.publicID, tags, results, err)
+			report.add(sv.publicID, sv.runID, tags, results, err)
+		}
+		report.Finished = time.Now().UTC()
+		if *reportPath != "" {
+			if err := report.write(*reportPath); err != nil {
+				log.Printf("warn: write report %s failed: %v", *reportPath, err)
+			}
+		}
+		if *summaryJSON {
+			if err := report.print(); err != nil {
+				log.Printf("warn: print summary json failed: %v", err)
+			}
 		}
+		return report.failed()
+	}
+	// runOnce 是一次轮询：同步所有 public_id
+	runOnce := func() (failed bool) {
+		if !running.TryLock() {
+			log.Printf("warn: previous sync still running (interval=%s); skipping this tick", *interval)
+			return false
+		}
+		defer running.Unlock()
+		return runCycle(servers, nil)
 	}
 
 	// 先跑一次
-	runOnce()
+	failed := runOnce()
 
-	// 周期轮询
+	// 推送：每个 public_id 一条连接；推送不丢弃，等正在跑的一轮结束后再同步
+	if *subscribeURL != "" {
+		for _, sv := range servers {
+			go watch(httpClient, *subscribeURL, tok, sv, *interval, func(sv *server, pushed *remote.FetchResult) {
+				running.Lock()
+				defer running.Unlock()
+				runCycle([]*server{sv}, pushed)
+			})
+		}
+	}
+
+	// 周期轮询（常驻模式下单轮失败不退出，靠 /healthz 与 webhook 告警）
 	if *interval > 0 {
-		t := time.NewTicker(*interval)
-		defer t.Stop()
-		for range t.C {
-			runOnce()
+		for {
+			time.Sleep(jittered(*interval, *jitter))
+			go runOnce()
 		}
 	}
 
-	fmt.Println("OK (snapshots →", filepath.Clean(*snapDir)+")")
-}
\ No newline at end of file
+	// 单次模式：有失败时以非 0 退出，便于 cron/CI 告警
+	if failed {
+		log.Printf("sync finished with failures; exit 1")
+		os.Exit(1)
+	}
+	switch {
+	case *summaryJSON: // stdout 只留给 JSON 汇总
+	case *snapDir == "":
+		fmt.Println("OK (snapshots disabled)")
+	default:
+		fmt.Println("OK (snapshots →", filepath.Clean(*snapDir)+")")
+	}
+}
+
+// server 是一个 public_id 对应的同步目标（各自的清单、快照目录与状态）
+type server struct {
+	publicID string
+	dbV, dbM *store.DB
+	snapDir  string
+
+	statePath  string
+	startState *runState
+	firstRun   bool
+
+	since  time.Time // 上次成功拉取的时间（-incremental 时作为 since）
+	fullAt time.Time // 上次全量同步成功的时间
+
+	runID string // 最近一轮的 syncer.RunResult.RunID（拉取失败时为空）
+}
+
+// jittered 返回 d 加上 [-frac*d, +frac*d] 内的均匀随机偏移（frac<=0 原样返回，>1 按 1 处理）
+func jittered(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	return d + time.Duration((rand.Float64()*2-1)*frac*float64(d))
+}
+
+// openDB 打开本地清单；文件损坏时拒绝启动（当成空库会导致全量重加或批量删除）
+func openDB(path, publicID string) *store.DB {
+	db, err := store.Open(path)
+	if errors.Is(err, store.ErrCorrupt) {
+		log.Printf("!!! local manifest is corrupt (public_id=%s): %v", publicID, err)
+		log.Fatalf("refusing to start: repair %s or remove it to resync from scratch", path)
+	}
+	if err != nil {
+		log.Fatalf("open db %s (public_id=%s): %v", path, publicID, err)
+	}
+	return db
+}
+
+// stringList 是可重复的字符串 flag（也接受逗号分隔）
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// parseOnly 解析 -only 列表；空串表示不过滤
+func parseOnly(s string) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch p {
+		case "":
+		case "vless", "vmess":
+			set[p] = true
+		default:
+			return nil, fmt.Errorf("unknown proto %q (vless|vmess)", p)
+		}
+	}
+	return set, nil
+}
+
+func newResult(proto string, tags []string, sum *syncer.Summary, err error) notify.Result {
+	r := notify.Result{Proto: proto, Tags: tags, Summary: sum}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// shouldNotify：任一协议删除/失败数达到阈值，或 Sync 本身报错时通知
+func shouldNotify(results []notify.Result, minRemoved, minFailed int64) bool {
+	for _, r := range results {
+		if r.Error != "" {
+			return true
+		}
+		if r.Summary == nil {
+			continue
+		}
+		if minRemoved > 0 && r.Summary.Removed >= minRemoved {
+			return true
+		}
+		if minFailed > 0 && r.Summary.Failed >= minFailed {
+			return true
+		}
+	}
+	return false
+}
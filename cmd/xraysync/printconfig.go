@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// 这些 flag 的值不打印原文
+var secretFlags = map[string]bool{"token": true, "api-key": true}
+
+// printConfig 输出解析后的有效配置（-print-config）：所有 flag 的取值与来源、token 来源、
+// 代理环境变量、以及每个 public_id 实际使用的 DB/快照/状态路径。token、-api-key 一律打码，
+// URL（-proxy、-webhook、代理环境变量等）里的 user:pass@ 一律去掉。
+func printConfig(w io.Writer, tokenSource string, servers []*server, dbPaths map[string][2]string) {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	fmt.Fprintln(w, "# flags（* 表示命令行显式给出，其余为默认值）")
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "print-config" {
+			return
+		}
+		v := f.Value.String()
+		switch {
+		case secretFlags[f.Name] && v != "":
+			v = redact(v)
+		case strings.Contains(v, "://"):
+			v = stripUserinfo(v)
+		}
+		mark := " "
+		if set[f.Name] {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s -%s=%q\n", mark, f.Name, v)
+	})
+
+	fmt.Fprintln(w, "# environment")
+	fmt.Fprintf(w, "  token: %s\n", tokenSource)
+	for _, k := range []string{"HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY"} {
+		if v, ok := lookupEnvAnyCase(k); ok {
+			fmt.Fprintf(w, "  %s=%q\n", k, stripUserinfo(v))
+		}
+	}
+
+	fmt.Fprintln(w, "# per public_id")
+	for _, sv := range servers {
+		db := dbPaths[sv.publicID]
+		fmt.Fprintf(w, "  %s: db.vless=%q db.vmess=%q snap=%q state=%q\n",
+			sv.publicID, db[0], db[1], sv.snapDir, sv.statePath)
+	}
+}
+
+// redact 只保留首尾各 2 个字符与长度，足以核对“是不是那个 token”
+func redact(s string) string {
+	if len(s) <= 8 {
+		return fmt.Sprintf("***(len=%d)", len(s))
+	}
+	return fmt.Sprintf("%s***%s(len=%d)", s[:2], s[len(s)-2:], len(s))
+}
+
+// stripUserinfo 去掉地址里的 user:pass@（有无 scheme 均可，与代理环境变量的写法一致）；没有时原样返回
+func stripUserinfo(s string) string {
+	scheme, rest := "", s
+	if i := strings.Index(s, "://"); i >= 0 {
+		scheme, rest = s[:i+3], s[i+3:]
+	}
+	authority := rest
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority = rest[:i]
+	}
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		return scheme + rest[at+1:]
+	}
+	return s
+}
+
+// lookupEnvAnyCase 与 net/http 的代理逻辑一致：大写优先，其次小写
+func lookupEnvAnyCase(k string) (string, bool) {
+	if v, ok := os.LookupEnv(k); ok {
+		return v, true
+	}
+	return os.LookupEnv(strings.ToLower(k))
+}
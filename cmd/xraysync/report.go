@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/notify"
+)
+
+// runReport 是 -summary-json 每轮输出到 stdout 的一行 JSON，也是 -report 写入的文件（字段只增不改）
+type runReport struct {
+	Time     time.Time      `json:"time"`
+	Finished time.Time      `json:"finished"`
+	OK       bool           `json:"ok"` // 所有 public_id 都无错误且 failed=0
+	Servers  []serverReport `json:"servers"`
+}
+
+type serverReport struct {
+	PublicID string              `json:"public_id"`
+	RunID    string              `json:"run_id,omitempty"`
+	Tags     map[string][]string `json:"tags,omitempty"`
+	Error    string              `json:"error,omitempty"`
+	Results  []notify.Result     `json:"results"`
+}
+
+func (r *runReport) add(publicID, runID string, tags map[string][]string, results []notify.Result, err error) {
+	sr := serverReport{PublicID: publicID, RunID: runID, Tags: tags, Results: results}
+	if sr.Results == nil {
+		sr.Results = []notify.Result{}
+	}
+	if err != nil {
+		sr.Error = err.Error()
+	}
+	r.Servers = append(r.Servers, sr)
+}
+
+// failed：任一 public_id 出错，或任一协议有失败的用户操作
+func (r *runReport) failed() bool {
+	for _, sr := range r.Servers {
+		if sr.Error != "" {
+			return true
+		}
+		for _, res := range sr.Results {
+			if res.Error != "" || (res.Summary != nil && res.Summary.Failed > 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// print 以单行 JSON 写到 stdout
+func (r *runReport) print() error {
+	r.OK = !r.failed()
+	return json.NewEncoder(os.Stdout).Encode(r)
+}
+
+// write 把报告原子写入 path（tmp + rename，缩进便于人工审阅）
+func (r *runReport) write(path string) error {
+	r.OK = !r.failed()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
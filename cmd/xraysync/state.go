@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/notify"
+)
+
+// runState 是上一次“成功同步”的记录，用于重启后判断远端是否有变化
+type runState struct {
+	Revision string          `json:"revision"` // 远端响应的摘要（remote.FetchResult.Revision）
+	Time     time.Time       `json:"time"`
+	Results  []notify.Result `json:"results"`
+
+	// 增量拉取（-incremental）：下次请求带上的 since，以及最近一次全量同步的时间
+	Since  time.Time `json:"since,omitempty"`
+	FullAt time.Time `json:"full_at,omitempty"`
+}
+
+// loadState 读取状态文件；文件不存在时返回 nil, nil
+func loadState(path string) (*runState, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st runState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// saveState 原子写入状态文件（tmp + rename）
+func saveState(path string, st runState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/notify"
+)
+
+// serverStatus 是某个 public_id 最近一轮的结果（/status 输出，字段只增不改）
+type serverStatus struct {
+	PublicID    string              `json:"public_id"`
+	Tags        map[string][]string `json:"tags,omitempty"`
+	LastRun     time.Time           `json:"last_run"`
+	LastSuccess time.Time           `json:"last_success"`
+	Error       string              `json:"error,omitempty"`
+	Results     []notify.Result     `json:"results,omitempty"`
+}
+
+// statusTracker 跨 runOnce 记录每个 public_id 的最近状态，供 /healthz 与 /status 使用
+type statusTracker struct {
+	mu       sync.Mutex
+	interval time.Duration
+	servers  map[string]*serverStatus
+	order    []string
+}
+
+func newStatusTracker(interval time.Duration) *statusTracker {
+	return &statusTracker{interval: interval, servers: make(map[string]*serverStatus)}
+}
+
+func (t *statusTracker) record(publicID string, tags map[string][]string, results []notify.Result, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.servers[publicID]
+	if !ok {
+		st = &serverStatus{PublicID: publicID}
+		t.servers[publicID] = st
+		t.order = append(t.order, publicID)
+	}
+	now := time.Now().UTC()
+	st.LastRun = now
+	if tags != nil {
+		st.Tags = tags
+	}
+	st.Results = results
+	st.Error = ""
+	if err != nil {
+		st.Error = err.Error()
+	} else {
+		st.LastSuccess = now
+	}
+}
+
+// healthy：每个 public_id 都在 2*interval 内成功过（单次模式下只看最近一轮是否成功）
+func (t *statusTracker) healthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.servers) == 0 {
+		return false
+	}
+	for _, st := range t.servers {
+		if st.LastSuccess.IsZero() {
+			return false
+		}
+		if t.interval > 0 && time.Since(st.LastSuccess) > 2*t.interval {
+			return false
+		}
+		if t.interval <= 0 && st.Error != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *statusTracker) snapshot() []serverStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]serverStatus, 0, len(t.order))
+	for _, id := range t.order {
+		out = append(out, *t.servers[id])
+	}
+	return out
+}
+
+func (t *statusTracker) serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !t.healthy() {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(struct {
+			Healthy bool           `json:"healthy"`
+			Servers []serverStatus `json:"servers"`
+		}{t.healthy(), t.snapshot()})
+	})
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+)
+
+// watch 保持 sv 的推送订阅：每条推送调用一次 onPush（推送不是完整清单时 pushed 为 nil，即照常拉取）。
+// 连接经由 c（与拉取相同的代理与 TLS 设置）；连接失败或断开后按 1s 起、翻倍、最多 maxBackoff 的间隔重连；其间同步由 -interval 轮询兜底。
+func watch(c *http.Client, wsURL, token string, sv *server, maxBackoff time.Duration, onPush func(sv *server, pushed *remote.FetchResult)) {
+	backoff := time.Second
+	for {
+		ch, err := remote.Subscribe(context.Background(), c, wsURL, token, sv.publicID)
+		if err != nil {
+			log.Printf("warn: subscribe %s failed (public_id=%s): %v; retry in %s, polling continues", wsURL, sv.publicID, err, backoff)
+		} else {
+			log.Printf("subscribed to %s (public_id=%s)", wsURL, sv.publicID)
+			backoff = time.Second
+			for u := range ch {
+				switch {
+				case errors.Is(u.Err, remote.ErrSubscriptionClosed):
+					log.Printf("warn: push connection lost (public_id=%s): %v; retry in %s, polling continues", sv.publicID, u.Err, backoff)
+				case u.Err != nil:
+					log.Printf("push is not a client list (public_id=%s): %v; fetching instead", sv.publicID, u.Err)
+					onPush(sv, nil)
+				default:
+					log.Printf("push received (public_id=%s clients=%d)", sv.publicID, len(u.Result.Clients))
+					onPush(sv, u.Result)
+				}
+			}
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
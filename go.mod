@@ -1,8 +1,13 @@
 module github.com/zionnode/xray-admin
 
-go 1.20
+go 1.21
 
-require github.com/xtls/xray-core v1.8.0
+require (
+	github.com/xtls/xray-core v1.8.0
+	golang.org/x/net v0.8.0
+	golang.org/x/time v0.3.0
+	google.golang.org/grpc v1.53.0
+)
 
 // 可选：如果你想显式声明工具链版本（Go 1.21+ 支持）
 toolchain go1.25.1
\ No newline at end of file
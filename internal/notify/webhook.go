@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/syncer"
+)
+
+// Result 是单个协议一次同步的结果
+type Result struct {
+	Proto   string          `json:"proto"` // vless | vmess
+	Tags    []string        `json:"tags"`
+	Summary *syncer.Summary `json:"summary,omitempty"`
+	Error   string          `json:"error,omitempty"` // Sync 返回的错误（为空表示正常结束）
+}
+
+// Payload 是 webhook 的请求体（字段是对外约定，只增不改）
+type Payload struct {
+	Time     time.Time `json:"time"`
+	PublicID string    `json:"public_id"`
+	RunID    string    `json:"run_id,omitempty"` // 同一远端内容重复同步时不变，接收方可据此去重
+	Results  []Result  `json:"results"`
+}
+
+// Post 把 payload 以 JSON POST 到 url；失败时等 1s 重试一次，仍失败则返回错误
+func Post(url string, payload Payload, timeout time.Duration) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	c := &http.Client{Timeout: timeout}
+
+	send := func() error {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := c.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			preview, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+			return fmt.Errorf("webhook status=%s; body=%.200q", resp.Status, preview)
+		}
+		return nil
+	}
+
+	if err = send(); err == nil {
+		return nil
+	}
+	time.Sleep(time.Second)
+	return send()
+}
@@ -2,10 +2,14 @@ package remote
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -13,20 +17,131 @@ import (
 type ClientLite struct {
 	ID    string `json:"id"`
 	Email string `json:"email"`
+	UID   string `json:"uid,omitempty"` // 可选：管理系统里的稳定用户标识；为空时用 email
+	Quota int64  `json:"quota,omitempty"` // 可选：流量配额（字节），0 表示不限
+	Note  string `json:"note,omitempty"`  // 可选：备注（套餐、地区等），原样存进清单
+
+	// 可选：到期时间（RFC3339）；过期的 client 不再下发，replace 模式下会被删除
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// 可选：该用户所属的 inbound tag（为空则按协议加入全部 tag；与某协议的 tag 无交集则不加入该协议）
+	Tags []string `json:"tags,omitempty"`
+
+	// 可选：按用户覆盖命令行的 -level / -flow（nil 表示沿用默认；flow 可显式给 "" 表示普通 VLESS）
+	Level *uint32 `json:"level,omitempty"`
+	Flow  *string `json:"flow,omitempty"`
+
+	// 可选：套餐名；没给 level 时可按 -plan-levels 映射成 level
+	Plan string `json:"plan,omitempty"`
+
+	// 可选，仅 VLESS 使用：Account.Encryption（为空即 none）
+	Encryption string `json:"encryption,omitempty"`
+
+	// 可选，仅 VMess 使用（旧客户端）
+	AlterID  uint32 `json:"alter_id,omitempty"`
+	Security string `json:"security,omitempty"`
 }
 
 type FetchResult struct {
 	TagsVLESS []string
 	TagsVMESS []string
 	Clients   []ClientLite
-	Raw       []byte
+	Raw       []byte // 规范化后的 JSON（用于快照）；FetchWith(keepRaw=false) 时为 nil
+	Revision  string // 规范化内容的 sha256（远端内容没变则不变；与 Raw 是否保留无关）
+
+	// Incremental 为 true 表示 Clients 只是 Since 之后有变动的用户（不能据此删除其他用户）
+	Incremental bool
+
+	incremental *bool // 响应里显式给出的 "incremental"（未给为 nil）
+
+	hasTags, hasClients bool // 响应里是否出现了 tags / clients 字段（供 Validate 检查）
+}
+
+// Expired 报告 client 在 now 时是否已过期（未设置到期时间的永不过期）
+func (c ClientLite) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !c.ExpiresAt.IsZero() && !now.Before(*c.ExpiresAt)
+}
+
+// ErrInvalidResponse 表示远端响应结构不符合预期（多半是上游改了格式）
+var ErrInvalidResponse = errors.New("invalid remote response")
+
+// Validate 检查解析结果是否像一份正常的清单：tags/clients 字段都在、二者不同时为空、
+// 每个 client 都有 id 与 email。有问题时返回包装了 ErrInvalidResponse 的错误，列出所有问题。
+func Validate(res *FetchResult) error {
+	var problems []string
+	if !res.hasTags {
+		problems = append(problems, `missing "tags"`)
+	}
+	if !res.hasClients {
+		problems = append(problems, `missing "clients"`)
+	}
+	if len(res.TagsVLESS) == 0 && len(res.TagsVMESS) == 0 && len(res.Clients) == 0 {
+		problems = append(problems, "no tags and no clients")
+	}
+	missing := 0
+	for _, c := range res.Clients {
+		if strings.TrimSpace(c.ID) == "" || strings.TrimSpace(c.Email) == "" {
+			missing++
+		}
+	}
+	if missing > 0 {
+		problems = append(problems, fmt.Sprintf("%d/%d clients without id or email", missing, len(res.Clients)))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidResponse, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// FetchOptions 是 FetchWith 的可选项（零值即全量拉取、不保留 Raw）
+type FetchOptions struct {
+	KeepRaw bool      // 保留 Raw（要写快照时才需要）
+	Since   time.Time // 非零时请求体带上 since（RFC3339），只拉取此后变动的用户
+}
+
+// NewHTTPClient 构造拉取用的 http.Client（不跟随重定向）。
+// proxyURL 为空时按环境变量 HTTP_PROXY/HTTPS_PROXY/NO_PROXY 选择代理。
+func NewHTTPClient(timeout time.Duration, proxyURL string) (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse proxy url failed: %w", err)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: tr,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
 }
 
 func Fetch(apiURL, token, publicID string, timeout time.Duration) (*FetchResult, error) {
-	body, _ := json.Marshal(map[string]string{
+	c, err := NewHTTPClient(timeout, "")
+	if err != nil {
+		return nil, err
+	}
+	return FetchWith(c, apiURL, token, publicID, FetchOptions{KeepRaw: true})
+}
+
+// FetchWith 与 Fetch 相同，但使用调用方提供的 http.Client（自定义代理、TLS 等）。
+// 响应体流式解析，不整体读入内存；opts.KeepRaw=false 时不保留 Raw（不写快照时用，省一份内存）。
+//
+// 带 Since 时结果默认视为增量（Incremental=true）；远端不支持而返回全量也无妨，
+// 只是本轮不做删除。远端可在响应里给 "incremental": false 明确表示这是全量。
+func FetchWith(c *http.Client, apiURL, token, publicID string, opts FetchOptions) (*FetchResult, error) {
+	reqBody := map[string]string{
 		"token":     token,
 		"public_id": publicID,
-	})
+	}
+	if !opts.Since.IsZero() {
+		reqBody["since"] = opts.Since.UTC().Format(time.RFC3339)
+	}
+	body, _ := json.Marshal(reqBody)
 	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
@@ -34,12 +149,6 @@ func Fetch(apiURL, token, publicID string, timeout time.Duration) (*FetchResult,
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	c := &http.Client{
-		Timeout: timeout,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
 	resp, err := c.Do(req)
 	if err != nil {
 		return nil, err
@@ -51,34 +160,74 @@ func Fetch(apiURL, token, publicID string, timeout time.Duration) (*FetchResult,
 		return nil, fmt.Errorf("remote status=%s; body=%.200q", resp.Status, preview)
 	}
 
-	// 2xx：读完整体（不要限 1MB，避免大 JSON 被截断）
-	b, err := io.ReadAll(resp.Body)
+	res, err := DecodeReader(resp.Body, opts.KeepRaw)
 	if err != nil {
-		return nil, fmt.Errorf("read body failed: %v", err)
+		return nil, err
+	}
+	res.Incremental = !opts.Since.IsZero() && (res.incremental == nil || *res.incremental)
+	return res, nil
+}
+
+// Decode 解析远端响应（或 Sync 写下的快照，二者同一种格式）
+func Decode(b []byte) (*FetchResult, error) {
+	return DecodeReader(bytes.NewReader(b), true)
+}
+
+// DecodeReader 用 json.Decoder 流式解析响应：clients 数组逐个解码，不先把整个正文读进内存。
+// Revision 总会计算；Raw 只在 keepRaw 时保留。
+func DecodeReader(r io.Reader, keepRaw bool) (*FetchResult, error) {
+	// 报错时也给一点正文预览，便于排查
+	pv := &preview{max: 200}
+	dec := json.NewDecoder(io.TeeReader(r, pv))
+	fail := func(err error) (*FetchResult, error) {
+		return nil, fmt.Errorf("decode json failed: %v; body=%.200q", err, pv.buf)
 	}
 
-	var envelope struct {
-		Tags    json.RawMessage `json:"tags"`
-		Clients []ClientLite    `json:"clients"`
+	var (
+		rawTags             json.RawMessage
+		clients             []ClientLite
+		incremental         *bool
+		hasTags, hasClients bool
+	)
+	if err := expectDelim(dec, '{'); err != nil {
+		return fail(err)
 	}
-	if err := json.Unmarshal(b, &envelope); err != nil {
-		// 报错时也给一点正文预览，便于排查
-		preview := string(b)
-		if len(preview) > 200 {
-			preview = preview[:200]
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return fail(err)
 		}
-		return nil, fmt.Errorf("decode json failed: %v; body=%.200q", err, preview)
+		key, _ := t.(string)
+		switch strings.ToLower(key) {
+		case "tags":
+			hasTags = true
+			err = dec.Decode(&rawTags)
+		case "clients":
+			hasClients = true
+			clients, err = decodeClients(dec)
+		case "incremental":
+			err = dec.Decode(&incremental)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return fail(err)
 	}
 
 	var tagsVLESS, tagsVMESS []string
 
 	// tags 可能是数组（旧格式）或对象（新格式）
 	var arr []string
-	if len(envelope.Tags) > 0 && json.Unmarshal(envelope.Tags, &arr) == nil {
+	if len(rawTags) > 0 && json.Unmarshal(rawTags, &arr) == nil {
 		tagsVLESS = nonEmpty(arr)
 	} else {
 		var obj map[string][]string
-		if len(envelope.Tags) > 0 && json.Unmarshal(envelope.Tags, &obj) == nil {
+		if len(rawTags) > 0 && json.Unmarshal(rawTags, &obj) == nil {
 			tagsVLESS = nonEmpty(append(obj["vless"], obj["VLESS"]...))
 			tagsVMESS = nonEmpty(append(obj["vmess"], obj["VMESS"]...))
 		}
@@ -98,15 +247,78 @@ func Fetch(apiURL, token, publicID string, timeout time.Duration) (*FetchResult,
 			VLESS: tagsVLESS,
 			VMESS: tagsVMESS,
 		},
-		Clients: envelope.Clients,
+		Clients: clients,
 	})
 
-	return &FetchResult{
+	res := &FetchResult{
 		TagsVLESS: tagsVLESS,
 		TagsVMESS: tagsVMESS,
-		Clients:   envelope.Clients,
-		Raw:       raw,
-	}, nil
+		Clients:   clients,
+		Revision:  revision(raw),
+
+		incremental: incremental,
+		hasTags:     hasTags,
+		hasClients:  hasClients,
+	}
+	if keepRaw {
+		res.Raw = raw
+	}
+	return res, nil
+}
+
+// decodeClients 逐个解码 clients 数组（null 视为空）
+func decodeClients(dec *json.Decoder) ([]ClientLite, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return nil, fmt.Errorf("clients: expect array, got %v", t)
+	}
+	var out []ClientLite
+	for dec.More() {
+		var c ClientLite
+		if err := dec.Decode(&c); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != want {
+		return fmt.Errorf("expect %q, got %v", want, t)
+	}
+	return nil
+}
+
+// preview 只记下正文的前 max 个字节
+type preview struct {
+	buf []byte
+	max int
+}
+
+func (p *preview) Write(b []byte) (int, error) {
+	if n := p.max - len(p.buf); n > 0 {
+		if len(b) < n {
+			n = len(b)
+		}
+		p.buf = append(p.buf, b[:n]...)
+	}
+	return len(b), nil
+}
+
+func revision(raw []byte) string {
+	h := sha256.Sum256(raw)
+	return hex.EncodeToString(h[:])
 }
 
 func nonEmpty(in []string) []string {
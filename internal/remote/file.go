@@ -0,0 +1,33 @@
+package remote
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ReadFile 从文件读取远端响应（如 Sync 写下的快照，.json 或归档后的 .json.gz），
+// 与 FetchWith 使用同一个解码器；结果总是视为全量（Incremental=false）。
+func ReadFile(path string, keepRaw bool) (*FetchResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("open gzip %s failed: %w", path, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	res, err := DecodeReader(r, keepRaw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return res, nil
+}
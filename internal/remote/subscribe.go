@@ -0,0 +1,92 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/websocket"
+)
+
+// Update 是 Subscribe 收到的一条推送
+type Update struct {
+	// Result 是推送内容按远端响应格式解码的结果（Raw 保留，可写快照）；
+	// 消息不是完整清单（如只是一条“有变化”的通知）时为 nil，Err 给出原因，调用方可改为 FetchWith 拉取
+	Result *FetchResult
+	Err    error
+}
+
+// ErrSubscriptionClosed 是连接断开时最后一条 Update 的 Err（包装了底层错误）
+var ErrSubscriptionClosed = errors.New("subscription closed")
+
+// Subscribe 连接远端的 WebSocket 推送（ws:// 或 wss://），先发送与 FetchWith 相同的
+// {"token","public_id"} 鉴权消息，之后每收到一条消息就向返回的 channel 发送一个 Update。
+// c 与 FetchWith 的相同（NewHTTPClient + ConfigureTLS）：连接沿用其代理与 TLS 设置，c.Timeout 限制建连耗时。
+// 推送内容默认视为全量；消息里显式给出 "incremental": true 时按增量处理。
+//
+// 连接断开时先发送一条 Err 包装了 ErrSubscriptionClosed 的 Update 再关闭 channel（ctx 取消时直接关闭）；
+// 不自动重连，由调用方决定重连与回退到轮询。
+func Subscribe(ctx context.Context, c *http.Client, wsURL, token, publicID string) (<-chan Update, error) {
+	conf, err := websocket.NewConfig(wsURL, originFor(wsURL))
+	if err != nil {
+		return nil, err
+	}
+	ws, err := dialWS(ctx, c, conf)
+	if err != nil {
+		return nil, err
+	}
+	hello, _ := json.Marshal(map[string]string{"token": token, "public_id": publicID})
+	if err := websocket.Message.Send(ws, string(hello)); err != nil {
+		_ = ws.Close()
+		return nil, fmt.Errorf("subscribe: send auth: %w", err)
+	}
+
+	ch := make(chan Update)
+	stop := context.AfterFunc(ctx, func() { _ = ws.Close() }) // 解除阻塞中的 Receive
+	go func() {
+		defer close(ch)
+		defer stop()
+		defer ws.Close()
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				if ctx.Err() == nil {
+					select {
+					case ch <- Update{Err: fmt.Errorf("%w: %v", ErrSubscriptionClosed, err)}:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+			u := Update{}
+			if u.Result, u.Err = DecodeReader(bytes.NewReader(msg), true); u.Err == nil {
+				u.Result.Incremental = u.Result.incremental != nil && *u.Result.incremental
+			} else {
+				u.Result = nil
+			}
+			select {
+			case ch <- u:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// originFor 由 ws(s)://host/... 推出握手所需的 Origin（http(s)://host）
+func originFor(wsURL string) string {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return "http://localhost"
+	}
+	scheme := "http"
+	if u.Scheme == "wss" {
+		scheme = "https"
+	}
+	return scheme + "://" + u.Host
+}
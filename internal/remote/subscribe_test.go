@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// connectProxy 是要求 Basic 认证的 HTTP CONNECT 代理，记录成功建立的隧道数
+func connectProxy(t *testing.T, user, pass string) (*httptest.Server, *int32) {
+	t.Helper()
+	var tunnels int32
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "connect only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != want {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		up, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		down, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			up.Close()
+			return
+		}
+		_, _ = io.WriteString(down, "HTTP/1.1 200 Connection established\r\n\r\n")
+		atomic.AddInt32(&tunnels, 1)
+		go func() { _, _ = io.Copy(up, down); up.Close() }()
+		go func() { _, _ = io.Copy(down, up); down.Close() }()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &tunnels
+}
+
+// wss 推送 + 需要认证的代理 + 自定义 CA：与 FetchWith 用同一个 http.Client 即可订阅
+func TestSubscribeThroughProxyWithTLS(t *testing.T) {
+	push := httptest.NewTLSServer(websocket.Handler(func(ws *websocket.Conn) {
+		var hello string
+		if err := websocket.Message.Receive(ws, &hello); err != nil || !strings.Contains(hello, `"public_id":"p1"`) {
+			return
+		}
+		_ = websocket.Message.Send(ws, `{"tags":{"vless":["v"]},"clients":[{"id":"11111111-1111-1111-1111-111111111111","email":"a@x"}]}`)
+		_, _ = io.Copy(io.Discard, ws) // 保持连接直到客户端关闭
+	}))
+	defer push.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: push.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	prx, tunnels := connectProxy(t, "u", "p@ss")
+	c, err := NewHTTPClient(5*time.Second, strings.Replace(prx.URL, "http://", "http://u:p%40ss@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureTLS(c, TLSFiles{CAFile: caFile}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := Subscribe(ctx, c, "wss"+strings.TrimPrefix(push.URL, "https"), "tok", "p1")
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	select {
+	case u := <-ch:
+		if u.Err != nil || u.Result == nil || len(u.Result.Clients) != 1 {
+			t.Fatalf("update = %+v", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no push received")
+	}
+	if n := atomic.LoadInt32(tunnels); n != 1 {
+		t.Errorf("proxy tunnels = %d, want 1", n)
+	}
+}
+
+func TestSubscribeProxyAuthFailure(t *testing.T) {
+	prx, _ := connectProxy(t, "u", "secret")
+	c, err := NewHTTPClient(5*time.Second, strings.Replace(prx.URL, "http://", "http://u:wrong@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Subscribe(context.Background(), c, "ws://push.invalid/ws", "tok", "p1")
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("err = %v, want proxy 407", err)
+	}
+}
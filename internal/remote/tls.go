@@ -0,0 +1,57 @@
+package remote
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSFiles 是访问远端 API 时使用的证书文件（均为 PEM；零值表示用系统默认 TLS）
+type TLSFiles struct {
+	CertFile string // 客户端证书（mTLS），需与 KeyFile 同时给出
+	KeyFile  string
+	CAFile   string // 校验服务端的 CA bundle（为空用系统根证书）
+}
+
+// ConfigureTLS 按 f 设置 c 的 Transport 的 TLS 配置；c 须由 NewHTTPClient 构造（Transport 为 *http.Transport）。
+// 代理设置保持不变，可与 -proxy 组合使用。
+func ConfigureTLS(c *http.Client, f TLSFiles) error {
+	if f == (TLSFiles{}) {
+		return nil
+	}
+	tr, ok := c.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("http client transport is not *http.Transport")
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tr.TLSClientConfig != nil {
+		cfg = tr.TLSClientConfig.Clone()
+	}
+
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return errors.New("client cert and key must be given together")
+	}
+	if f.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load client cert failed: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if f.CAFile != "" {
+		pem, err := os.ReadFile(f.CAFile)
+		if err != nil {
+			return fmt.Errorf("read ca file %s failed: %w", f.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in ca file %s", f.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	tr.TLSClientConfig = cfg
+	return nil
+}
@@ -0,0 +1,33 @@
+package remote
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TokenEnv 是默认读取 token 的环境变量
+const TokenEnv = "XRAY_ADMIN_TOKEN"
+
+// ResolveToken 按优先级取 token：显式值 > 文件（内容去首尾空白）> 环境变量 envKey。
+// 三者都没有时返回 "" 和 nil，由调用方决定是否必填。
+func ResolveToken(value, file, envKey string) (string, error) {
+	if v := strings.TrimSpace(value); v != "" {
+		return v, nil
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("read token file %s failed: %w", file, err)
+		}
+		v := strings.TrimSpace(string(b))
+		if v == "" {
+			return "", fmt.Errorf("token file %s is empty", file)
+		}
+		return v, nil
+	}
+	if envKey != "" {
+		return strings.TrimSpace(os.Getenv(envKey)), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,170 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/websocket"
+)
+
+// dialWS 按 c 的 Transport 建立 WebSocket 连接：代理（-proxy / HTTP(S)_PROXY，支持 http、https、socks5）
+// 与 TLS 配置（ConfigureTLS 设置的客户端证书、CA）都与 FetchWith 相同。c.Timeout 限制建连与握手的总耗时。
+// c 为 nil 或 Transport 不是 *http.Transport 时按 http.DefaultTransport 处理。
+func dialWS(ctx context.Context, c *http.Client, conf *websocket.Config) (*websocket.Conn, error) {
+	tr := http.DefaultTransport.(*http.Transport)
+	timeout := 15 * time.Second
+	if c != nil {
+		if t, ok := c.Transport.(*http.Transport); ok {
+			tr = t
+		}
+		if c.Timeout > 0 {
+			timeout = c.Timeout
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	target := conf.Location
+	secure := target.Scheme == "wss"
+	conn, err := dialThrough(ctx, tr, target, hostPort(target, secure))
+	if err != nil {
+		return nil, err
+	}
+	dl, _ := ctx.Deadline()
+	_ = conn.SetDeadline(dl) // 握手阶段也受超时约束，建好后清除
+	if secure {
+		tc := tls.Client(conn, tlsConfigFor(tr, target.Hostname()))
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	ws, err := websocket.NewClient(conf, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// dialThrough 经由 tr.Proxy 选出的代理（没有则直连）建立到 addr 的 TCP 连接
+func dialThrough(ctx context.Context, tr *http.Transport, target *url.URL, addr string) (net.Conn, error) {
+	dial := dialFunc((&net.Dialer{Timeout: 15 * time.Second}).DialContext)
+	if tr.DialContext != nil {
+		dial = tr.DialContext
+	}
+	var p *url.URL
+	if tr.Proxy != nil {
+		// ProxyFromEnvironment 按请求的 http/https 选 HTTP_PROXY/HTTPS_PROXY：ws 按 http、wss 按 https
+		scheme := "http"
+		if target.Scheme == "wss" {
+			scheme = "https"
+		}
+		var err error
+		if p, err = tr.Proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: target.Host}}); err != nil {
+			return nil, fmt.Errorf("proxy for %s: %w", target.Host, err)
+		}
+	}
+	switch {
+	case p == nil:
+		return dial(ctx, "tcp", addr)
+	case p.Scheme == "socks5" || p.Scheme == "socks5h":
+		d, err := proxy.FromURL(p, dial)
+		if err != nil {
+			return nil, err
+		}
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			return cd.DialContext(ctx, "tcp", addr)
+		}
+		return d.Dial("tcp", addr)
+	case p.Scheme == "http" || p.Scheme == "https":
+		return dialConnect(ctx, tr, dial, p, addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", p.Scheme)
+}
+
+// dialConnect 通过 HTTP(S) 代理的 CONNECT 隧道连到 addr（代理 URL 带 user:pass 时用 Basic 认证）
+func dialConnect(ctx context.Context, tr *http.Transport, dial dialFunc, p *url.URL, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", hostPort(p, p.Scheme == "https"))
+	if err != nil {
+		return nil, err
+	}
+	dl, _ := ctx.Deadline()
+	_ = conn.SetDeadline(dl)
+	if p.Scheme == "https" {
+		tc := tls.Client(conn, tlsConfigFor(tr, p.Hostname()))
+		if err := tc.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("proxy tls: %w", err)
+		}
+		conn = tc
+	}
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	for k, v := range tr.ProxyConnectHeader {
+		req.Header[k] = v
+	}
+	if u := p.User; u != nil {
+		pw, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pw)))
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy connect: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy connect: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy connect %s: %s", addr, resp.Status)
+	}
+	return conn, nil
+}
+
+// tlsConfigFor 复制 tr 的 TLS 配置（客户端证书、CA）；WebSocket 握手只能走 HTTP/1.1
+func tlsConfigFor(tr *http.Transport, host string) *tls.Config {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tr.TLSClientConfig != nil {
+		cfg = tr.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	cfg.NextProtos = []string{"http/1.1"}
+	return cfg
+}
+
+// hostPort 返回 u 的 host:port（未写端口时按 secure 补 443 或 80）
+func hostPort(u *url.URL, secure bool) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if secure {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// dialFunc 让 DialContext 形式的函数满足 proxy.Dialer / proxy.ContextDialer
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
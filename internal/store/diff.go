@@ -0,0 +1,106 @@
+package store
+
+import (
+	"sort"
+	"strings"
+)
+
+// Diff 计算清单 d 与目标集合 target 的差异（见包级 Diff）
+func (d *DB) Diff(target map[string]User, mode string) (adds, updates, deletes []User) {
+	return Diff(d.Snapshot(), target, mode)
+}
+
+// Diff 计算 have → want 的差异，三个结果都按 email 排序（便于跨轮对比日志）：
+// want 有而 have 没有 → adds；两边都有但 Equal 为 false → updates（取 want 中的新记录）；
+// mode 为 replace 时 have 有而 want 没有 → deletes（upsert 不删除）。
+func Diff(have, want map[string]User, mode string) (adds, updates, deletes []User) {
+	for uid, wu := range want {
+		if hu, ok := have[uid]; !ok {
+			adds = append(adds, wu)
+		} else if !Equal(hu, wu) {
+			updates = append(updates, wu)
+		}
+	}
+	if strings.EqualFold(mode, "replace") {
+		for uid, hu := range have {
+			if _, ok := want[uid]; !ok {
+				deletes = append(deletes, hu)
+			}
+		}
+	}
+	SortByEmail(adds)
+	SortByEmail(updates)
+	SortByEmail(deletes)
+	return
+}
+
+// Equal 判断两个用户在 Xray 上是否等价（不等价即需要 upd：删旧再加新）
+func Equal(a, b User) bool {
+	if a.Proto != b.Proto {
+		return false
+	}
+	if a.UUID != b.UUID || a.Level != b.Level {
+		return false
+	}
+	// VLESS 的 flow/encryption（含按 tag 的 flow）也要比对（VMess 忽略）
+	if a.Proto == "vless" && (strings.TrimSpace(a.Flow) != strings.TrimSpace(b.Flow) ||
+		strings.TrimSpace(a.Encryption) != strings.TrimSpace(b.Encryption) ||
+		!sameFlows(a.TagFlows, b.TagFlows)) {
+		return false
+	}
+	// VMess 的 alterId/security 也要比对
+	if a.Proto == "vmess" && (a.AlterID != b.AlterID ||
+		!strings.EqualFold(strings.TrimSpace(a.Security), strings.TrimSpace(b.Security))) {
+		return false
+	}
+	// 按用户指定的 tag 集合变了也要更新（删旧 tag、加新 tag）
+	if !sameSet(a.Tags, b.Tags) {
+		return false
+	}
+	// Quota、Note、ExpiresAt、MissingSince、StaleEmails、CreatedAt/UpdatedAt 不参与比较
+	// 以 UID 为键时 email 可能改名：改名按 upd 处理（删旧 email、加新 email），不走 del+add
+	if a.Email != b.Email {
+		return false
+	}
+	return true
+}
+
+// sameSet 判断两个字符串列表作为集合是否相同
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]bool, len(a))
+	for _, s := range a {
+		m[s] = true
+	}
+	for _, s := range b {
+		if !m[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameFlows 判断两组按 tag 的 flow 是否相同（nil 与空 map 等价）
+func sameFlows(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for tag, f := range a {
+		if g, ok := b[tag]; !ok || strings.TrimSpace(g) != strings.TrimSpace(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// SortByEmail 按 email 排序（email 相同时按 UID）
+func SortByEmail(us []User) {
+	sort.Slice(us, func(i, j int) bool {
+		if us[i].Email != us[j].Email {
+			return us[i].Email < us[j].Email
+		}
+		return us[i].UID < us[j].UID
+	})
+}
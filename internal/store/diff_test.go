@@ -0,0 +1,144 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func user(uid, email string) User {
+	return User{UID: uid, Email: email, UUID: "11111111-1111-1111-1111-111111111111", Proto: "vless", Level: 1}
+}
+
+func byUID(us ...User) map[string]User {
+	m := make(map[string]User, len(us))
+	for _, u := range us {
+		m[u.UID] = u
+	}
+	return m
+}
+
+func uids(us []User) []string {
+	var out []string
+	for _, u := range us {
+		out = append(out, u.UID)
+	}
+	return out
+}
+
+func sameList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDiffModes(t *testing.T) {
+	keep, gone, changed := user("keep", "keep@x"), user("gone", "gone@x"), user("chg", "chg@x")
+	changed2 := changed
+	changed2.Level = 2
+	fresh := user("new", "new@x")
+	have := byUID(keep, gone, changed)
+	want := byUID(keep, changed2, fresh)
+
+	for _, tc := range []struct {
+		mode                string
+		adds, upds, deletes []string
+	}{
+		{"replace", []string{"new"}, []string{"chg"}, []string{"gone"}},
+		{"upsert", []string{"new"}, []string{"chg"}, nil},
+		{"", []string{"new"}, []string{"chg"}, nil}, // 未知/空模式按 upsert：绝不删除
+	} {
+		adds, upds, dels := Diff(have, want, tc.mode)
+		if !sameList(uids(adds), tc.adds) || !sameList(uids(upds), tc.upds) || !sameList(uids(dels), tc.deletes) {
+			t.Errorf("mode %q: adds=%v upds=%v dels=%v, want %v/%v/%v",
+				tc.mode, uids(adds), uids(upds), uids(dels), tc.adds, tc.upds, tc.deletes)
+		}
+		if len(upds) == 1 && upds[0].Level != 2 {
+			t.Errorf("mode %q: update carries level %d, want the target record", tc.mode, upds[0].Level)
+		}
+	}
+}
+
+func TestDBDiff(t *testing.T) {
+	d := NewMemory()
+	if err := d.Save(byUID(user("a", "a@x"), user("b", "b@x"))); err != nil {
+		t.Fatal(err)
+	}
+	target := byUID(user("b", "b@x"), user("c", "c@x"))
+
+	adds, upds, dels := d.Diff(target, "replace")
+	if !sameList(uids(adds), []string{"c"}) || len(upds) != 0 || !sameList(uids(dels), []string{"a"}) {
+		t.Errorf("replace: adds=%v upds=%v dels=%v", uids(adds), uids(upds), uids(dels))
+	}
+	adds, upds, dels = d.Diff(target, "upsert")
+	if !sameList(uids(adds), []string{"c"}) || len(upds) != 0 || len(dels) != 0 {
+		t.Errorf("upsert: adds=%v upds=%v dels=%v", uids(adds), uids(upds), uids(dels))
+	}
+}
+
+func TestDiffSortedByEmail(t *testing.T) {
+	want := byUID(user("1", "z@x"), user("2", "a@x"), user("3", "m@x"))
+	adds, _, _ := Diff(nil, want, "replace")
+	var got []string
+	for _, u := range adds {
+		got = append(got, u.Email)
+	}
+	if !sameList(got, []string{"a@x", "m@x", "z@x"}) {
+		t.Errorf("adds = %v, want sorted by email", got)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	now := time.Now()
+	base := user("a", "a@x")
+	for _, tc := range []struct {
+		name string
+		mod  func(*User)
+		want bool
+	}{
+		{"identical", func(*User) {}, true},
+		{"level", func(u *User) { u.Level = 0 }, false},
+		{"flow", func(u *User) { u.Flow = "xtls-rprx-vision" }, false},
+		{"flow surrounding space", func(u *User) { u.Flow = "  " }, true},
+		{"tag flow", func(u *User) { u.TagFlows = map[string]string{"r": "xtls-rprx-vision"} }, false},
+		{"empty tag flows", func(u *User) { u.TagFlows = map[string]string{} }, true},
+		{"tags", func(u *User) { u.Tags = []string{"a"} }, false},
+		{"uuid", func(u *User) { u.UUID = "22222222-2222-2222-2222-222222222222" }, false},
+		{"email rename", func(u *User) { u.Email = "b@x" }, false},
+		{"encryption", func(u *User) { u.Encryption = "mlkem768x25519plus" }, false},
+		{"audit/bookkeeping ignored", func(u *User) {
+			u.Quota, u.Note, u.CreatedAt, u.UpdatedAt = 1, "n", now, now
+			u.ExpiresAt, u.MissingSince, u.StaleEmails = &now, &now, []string{"old@x"}
+		}, true},
+	} {
+		u := base
+		tc.mod(&u)
+		if got := Equal(base, u); got != tc.want {
+			t.Errorf("%s: Equal = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// tags 按集合比较，顺序无关
+	a, b := base, base
+	a.Tags, b.Tags = []string{"x", "y"}, []string{"y", "x"}
+	if !Equal(a, b) {
+		t.Error("tags in different order should be equal")
+	}
+
+	// VMess：flow 不参与，alterId/security（大小写无关）参与
+	vm := base
+	vm.Proto = "vmess"
+	vm.Security = "AES-128-GCM"
+	vmFlow, vmSec, vmAlter := vm, vm, vm
+	vmFlow.Flow = "xtls-rprx-vision"
+	vmSec.Security = "aes-128-gcm"
+	vmAlter.AlterID = 4
+	if !Equal(vm, vmFlow) || !Equal(vm, vmSec) || Equal(vm, vmAlter) {
+		t.Error("vmess comparison: flow ignored, security case-insensitive, alterId compared")
+	}
+}
@@ -1,26 +1,33 @@
 package store
 
-import (
-	"encoding/json"
-	"os"
-	"path/filepath"
-)
+// Load 返回当前清单的一份拷贝（Sync 以它作为“已下发”的集合）
+func (d *DB) Load() (map[string]User, error) {
+	return d.Snapshot(), nil
+}
 
-// 如果 DB 有互斥锁（mu）建议加锁；没有也可先不加。
-func (db *DB) Save(m map[string]User) error {
-	// ——以下假设 DB 里有 unexported 的 `path string` 字段——
-	// 大多数文件型 DB 都会这样命名。如果你不是叫 path，而是 file/filename等，
-	// 把 db.path 按你的字段名改一下即可。
-	if err := os.MkdirAll(filepath.Dir(db.path), 0o755); err != nil {
-		return err
-	}
-	b, err := json.MarshalIndent(m, "", "  ")
-	if err != nil {
-		return err
+// Save 用 m 整体替换清单并落盘（内存与文件保持一致，下一轮 Load 能看到）
+func (d *DB) Save(m map[string]User) error {
+	return d.ReplaceAll(m)
+}
+
+// Disabled 返回禁用集合的一份拷贝
+func (d *DB) Disabled() map[string]int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]int64, len(d.DisabledUsers))
+	for k, v := range d.DisabledUsers {
+		out[k] = v
 	}
-	tmp := db.path + ".tmp"
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
-		return err
+	return out
+}
+
+// SetDisabled 整体替换禁用集合（只改内存，随下一次 Save 一并落盘）
+func (d *DB) SetDisabled(m map[string]int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.DisabledUsers = make(map[string]int64, len(m))
+	for k, v := range m {
+		d.DisabledUsers[k] = v
 	}
-	return os.Rename(tmp, db.path)
-}
\ No newline at end of file
+	return nil
+}
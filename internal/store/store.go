@@ -1,10 +1,14 @@
 package store
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 // User 是我们在本地保存的“权威用户”结构（以 UID/email 为键）
@@ -15,29 +19,115 @@ type User struct {
 	Proto string `json:"proto"` // vless | vmess
 	Level uint32 `json:"level"`
 	Flow  string `json:"flow"`  // 普通 VLESS 留空；Vision 时为 "xtls-rprx-vision"
+
+	// 仅 VLESS：Account.Encryption（空值即 Xray 默认 none）
+	Encryption string `json:"encryption,omitempty"`
+
+	// 仅 VLESS：按 tag 覆盖的 flow（来自 -flow-map，只记录与 Flow 不同的 tag）
+	TagFlows map[string]string `json:"tag_flows,omitempty"`
+
+	// 仅 VMess：旧客户端可能需要 alterId / 指定加密（空值即 Xray 默认：0 / auto）
+	AlterID  uint32 `json:"alter_id,omitempty"`
+	Security string `json:"security,omitempty"`
+
+	// 按用户指定的 inbound tag（为空表示该协议的全部 tag）
+	Tags []string `json:"tags,omitempty"`
+
+	// 流量配额（字节，0 表示不限）；不参与差异比较
+	Quota int64 `json:"quota,omitempty"`
+
+	// 备注（套餐、地区等自由文本），只随清单保存供导出查看；不参与差异比较
+	Note string `json:"note,omitempty"`
+
+	// 到期时间（来自远端 expires_at，为空表示不过期）；到期后由同步移除，不参与差异比较
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// 远端首次不再包含该用户的时间（-remove-grace 期间仍保留在 Xray 与清单里）；重新出现即清空，不参与差异比较
+	MissingSince *time.Time `json:"missing_since,omitempty"`
+
+	// 改名后从 Xray 删除旧 email 失败时记下的旧 email（由 syncer 维护，每轮重试删除，成功后清空）；不参与差异比较
+	StaleEmails []string `json:"stale_emails,omitempty"`
+
+	// 审计时间（由 syncer 写清单时维护）；不参与差异比较，零值表示早于该字段引入
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
-// DB 是一个简单的 JSON 文件数据库，键为 UID
+// FlowFor 返回该用户在 tag 上使用的 flow（TagFlows 优先，否则 Flow）
+func (u User) FlowFor(tag string) string {
+	if f, ok := u.TagFlows[tag]; ok {
+		return f
+	}
+	return u.Flow
+}
+
+// Store 是 syncer 需要的清单读写能力（*DB 的文件版与内存版都实现它）
+type Store interface {
+	Load() (map[string]User, error)
+	Save(map[string]User) error
+
+	// 因超配额被禁用的用户（UID → 禁用时的累计流量）；SetDisabled 不单独落盘，随下一次 Save 一起写，
+	// 这样被删除保护或确认中止的一轮不会留下半份状态
+	Disabled() map[string]int64
+	SetDisabled(map[string]int64) error
+}
+
+// DB 是一个简单的 JSON 文件数据库，键为 UID（path 为空时为纯内存库）
 type DB struct {
 	path  string
 	mu    sync.Mutex
 	Users map[string]User `json:"users"`
+
+	// 超配额而被移出 inbound 的用户，远端清掉配额前不会再下发
+	DisabledUsers map[string]int64 `json:"disabled,omitempty"`
+
+	// Backups>0 时每次写盘前把现有文件留一份备份：<path>.bak 最新，<path>.bak.1 … 依次更旧，
+	// 共保留 Backups 份（0 表示不备份）
+	Backups int `json:"-"`
 }
 
+// ErrCorrupt 表示清单文件非空但无法解析（原文件已备份为 <path>.corrupt）
+var ErrCorrupt = errors.New("store: corrupt db file")
+
 // Open 打开（或初始化）本地 DB 文件。如果不存在会创建空库。
+// 文件非空却解析失败时不会当成空库（那会触发全量重加或批量删除）：
+// 先把原文件备份到 <path>.corrupt，再返回包装了 ErrCorrupt 的错误，由调用方决定是否继续。
 func Open(path string) (*DB, error) {
 	_ = os.MkdirAll(filepath.Dir(path), 0o755)
 	db := &DB{path: path, Users: map[string]User{}}
 
-	f, err := os.Open(path)
-	if err == nil {
-		defer f.Close()
-		_ = json.NewDecoder(f).Decode(db) // 读失败也不致命，保持空库
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return db, nil
+	}
+	if err := json.Unmarshal(b, db); err != nil {
+		bak := path + ".corrupt"
+		if werr := os.WriteFile(bak, b, 0o644); werr != nil {
+			return nil, fmt.Errorf("%w: %s: %v (backup failed: %v)", ErrCorrupt, path, err, werr)
+		}
+		return nil, fmt.Errorf("%w: %s: %v (backup: %s)", ErrCorrupt, path, err, bak)
+	}
+	if db.Users == nil {
+		db.Users = map[string]User{}
 	}
 	return db, nil
 }
 
+// NewMemory 返回不落盘的内存库：用于测试和不需要本地清单的无状态节点
+func NewMemory() *DB {
+	return &DB{Users: map[string]User{}}
+}
+
 func (d *DB) save() error {
+	if d.path == "" {
+		return nil // 内存库
+	}
 	tmp := d.path + ".tmp"
 	f, err := os.Create(tmp)
 	if err != nil {
@@ -52,9 +142,44 @@ func (d *DB) save() error {
 	if err := f.Close(); err != nil {
 		return err
 	}
+	if err := d.backup(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("backup %s failed: %w", d.path, err)
+	}
 	return os.Rename(tmp, d.path)
 }
 
+// backup 轮转旧备份，再把当前文件保存为 <path>.bak（文件还不存在时什么也不做）
+func (d *DB) backup() error {
+	if d.Backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(d.path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	name := func(i int) string {
+		if i == 0 {
+			return d.path + ".bak"
+		}
+		return fmt.Sprintf("%s.bak.%d", d.path, i)
+	}
+	_ = os.Remove(name(d.Backups - 1))
+	for i := d.Backups - 2; i >= 0; i-- {
+		if err := os.Rename(name(i), name(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// 硬链接即可（随后 rename 会让 path 指向新文件）；不支持时退回复制
+	if err := os.Link(d.path, name(0)); err == nil {
+		return nil
+	}
+	b, err := os.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name(0), b, 0o644)
+}
+
 // Upsert 写入/更新一个用户（以 UID 为键）
 func (d *DB) Upsert(u User) error {
 	d.mu.Lock()
@@ -0,0 +1,114 @@
+package syncer
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/zionnode/xray-admin/internal/xray"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// autoStart 是自适应并发的起步值
+const autoStart = 4
+
+// adaptiveLimiter 是 AIMD 式的在途任务上限：从 start 起步，每连续成功 limit 个任务加 1（不超过 max），
+// 遇到 Unavailable/ResourceExhausted/DeadlineExceeded 减半（不低于 1）。nil 时不限制。
+type adaptiveLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	max      int
+	inflight int
+	streak   int // 自上次调整以来的连续成功数
+	peak     int
+	backoffs int
+}
+
+func newAdaptiveLimiter(start, max int) *adaptiveLimiter {
+	if start > max {
+		start = max
+	}
+	if start < 1 {
+		start = 1
+	}
+	l := &adaptiveLimiter{limit: start, max: max, peak: start}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+func (l *adaptiveLimiter) acquire() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	for l.inflight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inflight++
+	l.mu.Unlock()
+}
+
+func (l *adaptiveLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.inflight--
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// observe 按每次 Add/Remove 调用（含重试中的每一次）的结果调整上限
+func (l *adaptiveLimiter) observe(err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if overloaded(err) {
+		if l.limit > 1 {
+			l.limit /= 2
+		}
+		l.streak = 0
+		l.backoffs++
+		return
+	}
+	if l.streak++; l.streak >= l.limit && l.limit < l.max {
+		l.limit++
+		l.streak = 0
+		if l.limit > l.peak {
+			l.peak = l.limit
+		}
+		l.cond.Broadcast()
+	}
+}
+
+// stats 返回当前上限、达到过的最高值与回退次数
+func (l *adaptiveLimiter) stats() (limit, peak, backoffs int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit, l.peak, l.backoffs
+}
+
+// overloaded：Xray 端过载或连接吃紧的信号（多 tag 时任一 tag 命中即算）
+func overloaded(err error) bool {
+	if err == nil {
+		return false
+	}
+	var te xray.TagErrors
+	if errors.As(err, &te) {
+		for _, e := range te {
+			if overloaded(e.Err) {
+				return true
+			}
+		}
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package syncer
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/zionnode/xray-admin/internal/store"
+	"github.com/zionnode/xray-admin/internal/xray"
+
+	"google.golang.org/grpc/status"
+)
+
+// Changes 是一轮同步中真正生效的变更（按 email 排序；幂等跳过的不计入）。
+// 仅在 SyncOptions.RecordChanges 为 true 时填充，供 -report 等审计输出使用。
+type Changes struct {
+	Added   []string `json:"added"`
+	Updated []string `json:"updated"`
+	Removed []string `json:"removed"`
+}
+
+// FailureDetail 是一次失败的用户操作（见 Summary.Failures）；多 tag 操作每个失败的 tag 各记一条
+type FailureDetail struct {
+	Op       string `json:"op"` // add | del | upd-remove | upd-add
+	Email    string `json:"email"`
+	Proto    string `json:"proto"`
+	Endpoint string `json:"endpoint,omitempty"` // 多端点时的 Xray 地址
+	Tag      string `json:"tag,omitempty"`      // 失败的 inbound tag（非 tag 级错误时为空）
+	Code     string `json:"code,omitempty"`     // gRPC code（非 gRPC 错误时为空）
+	Msg      string `json:"msg"`
+}
+
+// DefaultMaxFailures 是 SyncOptions.MaxFailures 为 0 时最多保留的失败明细条数
+const DefaultMaxFailures = 100
+
+// changeLog 在 worker 间并发收集 Changes；为 nil 时所有方法都是空操作
+type changeLog struct {
+	mu sync.Mutex
+	c  Changes
+}
+
+func (l *changeLog) added(email string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.c.Added = append(l.c.Added, email)
+	l.mu.Unlock()
+}
+
+func (l *changeLog) updated(email string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.c.Updated = append(l.c.Updated, email)
+	l.mu.Unlock()
+}
+
+func (l *changeLog) removed(email string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.c.Removed = append(l.c.Removed, email)
+	l.mu.Unlock()
+}
+
+// result 返回排序、去重后的 Changes（多端点时同一 email 只记一次）
+func (l *changeLog) result() *Changes {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.c
+	c.Added, c.Updated, c.Removed = uniqSorted(c.Added), uniqSorted(c.Updated), uniqSorted(c.Removed)
+	return &c
+}
+
+// failureLog 并发收集失败明细，最多保留 max 条（其余只计数）
+type failureLog struct {
+	mu      sync.Mutex
+	max     int
+	list    []FailureDetail
+	dropped int64
+}
+
+func newFailureLog(max int) *failureLog {
+	if max == 0 {
+		max = DefaultMaxFailures
+	}
+	return &failureLog{max: max}
+}
+
+func (l *failureLog) add(op string, u store.User, endpoint string, err error) {
+	base := FailureDetail{Op: op, Email: u.Email, Proto: u.Proto, Endpoint: endpoint}
+	var list []FailureDetail
+	var te xray.TagErrors
+	if errors.As(err, &te) {
+		for _, e := range te {
+			f := base
+			f.Tag = e.Tag
+			f.Code, f.Msg = failureCode(e.Err)
+			list = append(list, f)
+		}
+	} else {
+		base.Code, base.Msg = failureCode(err)
+		list = append(list, base)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, f := range list {
+		if len(l.list) >= l.max {
+			l.dropped++
+			continue
+		}
+		l.list = append(l.list, f)
+	}
+}
+
+// failureCode 取出 err 的 gRPC code 与消息；err 包装了 gRPC 状态（如 rollback: ...）时保留完整文案
+func failureCode(err error) (code, msg string) {
+	if st, ok := status.FromError(err); ok {
+		return st.Code().String(), st.Message()
+	}
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus().Code().String(), err.Error()
+	}
+	return "", err.Error()
+}
+
+// result 返回按 email（同 email 按 tag）排序的明细与未保留的条数
+func (l *failureLog) result() ([]FailureDetail, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := append([]FailureDetail(nil), l.list...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Email != out[j].Email {
+			return out[i].Email < out[j].Email
+		}
+		return out[i].Tag < out[j].Tag
+	})
+	return out, l.dropped
+}
+
+func uniqSorted(in []string) []string {
+	out := make([]string, 0, len(in))
+	sort.Strings(in)
+	for i, s := range in {
+		if i == 0 || s != in[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,40 @@
+package syncer
+
+import (
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/store"
+)
+
+// deferRemovals 对计划删除的用户应用宽限期：首次缺席时在清单里记下 MissingSince 并保留，
+// 缺席满 grace 后才真正删除。返回真正要删的用户、加回了待删用户的目标集合（副本），以及暂缓的个数。
+// skip 里的 UID（如超配额禁用）不参与宽限，照常删除。
+func deferRemovals(dels []store.User, users map[string]store.User, skip []store.User, grace time.Duration, now time.Time) ([]store.User, map[string]store.User, int) {
+	forced := make(map[string]bool, len(skip))
+	for _, u := range skip {
+		forced[u.UID] = true
+	}
+	out := make(map[string]store.User, len(users)+len(dels))
+	for uid, u := range users {
+		out[uid] = u
+	}
+	var due []store.User
+	pending := 0
+	for _, u := range dels {
+		switch {
+		case forced[u.UID]:
+			due = append(due, u)
+		case u.MissingSince == nil:
+			t := now
+			u.MissingSince = &t
+			out[u.UID] = u
+			pending++
+		case now.Sub(*u.MissingSince) < grace:
+			out[u.UID] = u
+			pending++
+		default:
+			due = append(due, u)
+		}
+	}
+	return due, out, pending
+}
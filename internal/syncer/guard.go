@@ -0,0 +1,64 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrTooManyRemovals 表示本轮计划删除数超过 MaxRemovals，Sync 已放弃执行
+var ErrTooManyRemovals = errors.New("too many removals")
+
+// ErrRemovalsNotConfirmed 表示 SyncOptions.ConfirmRemovals 拒绝了本轮的删除，Sync 已放弃执行
+var ErrRemovalsNotConfirmed = errors.New("removals not confirmed")
+
+// RemovalLimit 是 replace 模式单轮删除上限（零值不限制）：
+// Count>0 为绝对数；Percent>0 为占本地清单的百分比。两者都设置时任一超出即拦截。
+type RemovalLimit struct {
+	Count   int
+	Percent float64
+}
+
+// ParseRemovalLimit 解析 "500" 或 "10%"；空串表示不限制
+func ParseRemovalLimit(s string) (RemovalLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return RemovalLimit{}, nil
+	}
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || v <= 0 || v > 100 {
+			return RemovalLimit{}, fmt.Errorf("invalid percentage %q", s)
+		}
+		return RemovalLimit{Percent: v}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return RemovalLimit{}, fmt.Errorf("invalid removal limit %q", s)
+	}
+	return RemovalLimit{Count: n}, nil
+}
+
+// exceeded 判断 dels 个删除（清单共 have 个用户）是否超限
+func (l RemovalLimit) exceeded(dels, have int) bool {
+	if l.Count > 0 && dels > l.Count {
+		return true
+	}
+	if l.Percent > 0 && have > 0 && float64(dels)*100/float64(have) > l.Percent {
+		return true
+	}
+	return false
+}
+
+func (l RemovalLimit) String() string {
+	switch {
+	case l.Count > 0 && l.Percent > 0:
+		return fmt.Sprintf("%d/%g%%", l.Count, l.Percent)
+	case l.Percent > 0:
+		return fmt.Sprintf("%g%%", l.Percent)
+	case l.Count > 0:
+		return strconv.Itoa(l.Count)
+	}
+	return "unlimited"
+}
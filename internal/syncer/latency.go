@@ -0,0 +1,60 @@
+package syncer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyStats 是一轮 Sync 中单次 Add/Remove 调用（一个用户、所有目标 tag）的耗时分位数
+type LatencyStats struct {
+	Calls int     `json:"calls"`
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
+	MaxMs float64 `json:"max_ms"`
+}
+
+// latencyRecorder 收集每次调用的耗时（所有 worker 共用）
+type latencyRecorder struct {
+	mu sync.Mutex
+	d  []time.Duration
+}
+
+func (r *latencyRecorder) observe(d time.Duration) {
+	r.mu.Lock()
+	r.d = append(r.d, d)
+	r.mu.Unlock()
+}
+
+// stats 按 nearest-rank 计算分位数；没有调用时返回 nil
+func (r *latencyRecorder) stats() *LatencyStats {
+	r.mu.Lock()
+	d := append([]time.Duration(nil), r.d...)
+	r.mu.Unlock()
+	if len(d) == 0 {
+		return nil
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	pct := func(p float64) float64 {
+		i := int(p*float64(len(d))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(d) {
+			i = len(d) - 1
+		}
+		return ms(d[i])
+	}
+	return &LatencyStats{
+		Calls: len(d),
+		P50Ms: pct(0.50),
+		P95Ms: pct(0.95),
+		P99Ms: pct(0.99),
+		MaxMs: ms(d[len(d)-1]),
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,124 @@
+package syncer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+	"github.com/zionnode/xray-admin/internal/store"
+)
+
+// ParseFlowMap 解析 "tag=flow,tag2=flow2"（flow 可为空，表示该 tag 用普通 VLESS）
+func ParseFlowMap(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	out := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		tag, flow, ok := strings.Cut(kv, "=")
+		tag = strings.TrimSpace(tag)
+		if !ok || tag == "" {
+			return nil, fmt.Errorf("invalid flow mapping %q (want tag=flow)", kv)
+		}
+		out[tag] = strings.TrimSpace(flow)
+	}
+	return out, nil
+}
+
+// ApplyFlowMap 为 VLESS 用户记录按 tag 的 flow：用户所在 tag（u.Tags，为空即 tags）命中 flowMap 时，
+// 该 tag 使用映射的 flow，优先于默认值与远端按用户给出的 flow；与 u.Flow 相同的不记录。
+func ApplyFlowMap(users map[string]store.User, tags []string, flowMap map[string]string) {
+	if len(flowMap) == 0 {
+		return
+	}
+	for uid, u := range users {
+		if u.Proto != "vless" {
+			continue
+		}
+		own := u.Tags
+		if len(own) == 0 {
+			own = tags
+		}
+		var tf map[string]string
+		for _, t := range own {
+			if f, ok := flowMap[t]; ok && f != u.Flow {
+				if tf == nil {
+					tf = make(map[string]string)
+				}
+				tf[t] = f
+			}
+		}
+		u.TagFlows = tf
+		users[uid] = u
+	}
+}
+
+// ParsePlanLevels 解析 "basic=0,pro=1"（套餐名 → Xray level）
+func ParsePlanLevels(s string) (map[string]uint32, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	out := make(map[string]uint32)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		plan, lv, ok := strings.Cut(kv, "=")
+		plan = strings.TrimSpace(plan)
+		n, err := strconv.ParseUint(strings.TrimSpace(lv), 10, 32)
+		if !ok || plan == "" || err != nil {
+			return nil, fmt.Errorf("invalid plan level %q (want plan=level)", kv)
+		}
+		out[plan] = uint32(n)
+	}
+	return out, nil
+}
+
+// ApplyPlanLevels 返回 client 列表副本：没给 level 但 plan 在 levels 里的，level 取映射值
+// （优先级：远端 level > 套餐映射 > 默认 -level）
+func ApplyPlanLevels(clients []remote.ClientLite, levels map[string]uint32) []remote.ClientLite {
+	if len(levels) == 0 {
+		return clients
+	}
+	out := make([]remote.ClientLite, len(clients))
+	for i, c := range clients {
+		if lv, ok := levels[c.Plan]; ok && c.Level == nil {
+			c.Level = &lv
+		}
+		out[i] = c
+	}
+	return out
+}
+
+// ParseIdentity 校验 -identity 的取值（空串即 email）
+func ParseIdentity(s string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(s)); v {
+	case "", "email":
+		return "email", nil
+	case "uuid":
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown identity %q (email|uuid)", s)
+}
+
+// ApplyIdentity 在 identity 为 "uuid" 时返回以 UUID 充当 Xray email 的 client 列表副本
+// （用于 inbound 当初以 UUID 作为 email 开通的情况）。清单主键不变：远端没给 uid 时仍用原 email，
+// 因此切换 identity 表现为一次改名更新（删旧标识、加新标识）。
+func ApplyIdentity(clients []remote.ClientLite, identity string) []remote.ClientLite {
+	if identity != "uuid" {
+		return clients
+	}
+	out := make([]remote.ClientLite, len(clients))
+	for i, c := range clients {
+		if c.UID == "" {
+			c.UID = c.Email
+		}
+		c.Email = c.ID
+		out[i] = c
+	}
+	return out
+}
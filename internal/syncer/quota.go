@@ -0,0 +1,63 @@
+package syncer
+
+import (
+	"log"
+	"log/slog"
+
+	"github.com/zionnode/xray-admin/internal/store"
+	"github.com/zionnode/xray-admin/internal/xray"
+)
+
+// applyQuota 剔除超配额的用户：
+//   - 已在禁用集合里、且远端仍给了配额的 → 继续禁用（远端把 quota 清零才解禁）
+//   - 累计流量 >= quota 的 → 新禁用
+//
+// 返回剔除后的目标集合、清单里仍存在且必须从 Xray 删除的禁用用户（upsert 模式也要删）、
+// 新的禁用集合与其中本轮新增的个数。这里不写 db：禁用集合由调用方在保护检查通过后随清单一起保存。
+// 多端点时流量按端点累加；任一端点查询失败即视为查不到（避免按部分流量误判）。
+func applyQuota(clis []*xray.Client, db store.Store, want, have map[string]store.User) (map[string]store.User, []store.User, map[string]int64, int64) {
+	disabled := db.Disabled()
+
+	traffic := make(map[string]int64)
+	for _, cli := range clis {
+		t, err := cli.UserTraffic()
+		if err != nil {
+			// 查不到流量时只沿用已有禁用集合，不新增
+			log.Printf("warn: query user traffic failed: %v", err)
+			traffic = nil
+			break
+		}
+		for email, v := range t {
+			traffic[email] += v
+		}
+	}
+
+	next := make(map[string]int64)
+	out := make(map[string]store.User, len(want))
+	var newly int64
+	for uid, u := range want {
+		if u.Quota <= 0 {
+			out[uid] = u
+			continue
+		}
+		if used, ok := disabled[uid]; ok {
+			next[uid] = used
+			continue
+		}
+		if used := traffic[u.Email]; traffic != nil && used >= u.Quota {
+			next[uid] = used
+			newly++
+			slog.Info("DISABLE", "proto", u.Proto, "uid", uid, "email", u.Email, "used", used, "quota", u.Quota)
+			continue
+		}
+		out[uid] = u
+	}
+
+	var dels []store.User
+	for uid := range next {
+		if hu, ok := have[uid]; ok {
+			dels = append(dels, hu)
+		}
+	}
+	return out, dels, next, newly
+}
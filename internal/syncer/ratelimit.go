@@ -0,0 +1,42 @@
+package syncer
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// NewRateLimiter 返回把调用均匀摊开到每秒 perSec 次的限速器（无突发，即令牌桶容量为 1）；perSec<=0 时返回 nil（不限速）。
+// 限的是一个 Xray 进程承受的 AlterInbound 速率，所以同一端点上的所有调用（各 worker、各协议的 Sync）应共用一个。
+func NewRateLimiter(perSec float64) *rate.Limiter {
+	if perSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSec), 1)
+}
+
+// RateLimiters 为 xrayAddr（逗号分隔多个端点）里的每个端点建一个限速器（perSec<=0 时返回 nil）
+func RateLimiters(xrayAddr string, perSec float64) map[string]*rate.Limiter {
+	if perSec <= 0 {
+		return nil
+	}
+	out := make(map[string]*rate.Limiter)
+	for _, ep := range splitEndpoints(xrayAddr) {
+		out[ep] = NewRateLimiter(perSec)
+	}
+	return out
+}
+
+// throttle 把 l 包装成 xray.Client.Throttle：排队等待时隙，ctx 取消或到期即返回。
+// rate.Limiter.Wait 预计在 ctx 截止前等不到时隙会立即报错；这里改为等到截止再返回 ctx.Err()，
+// 让 Sync 按整轮超时处理（不写清单），而不是把剩余任务逐个记为失败。
+func throttle(l *rate.Limiter) func(context.Context) error {
+	return func(ctx context.Context) error {
+		err := l.Wait(ctx)
+		if _, ok := ctx.Deadline(); err != nil && ok {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return err
+	}
+}
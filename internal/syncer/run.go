@@ -0,0 +1,479 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+	"github.com/zionnode/xray-admin/internal/store"
+	"github.com/zionnode/xray-admin/internal/xray"
+)
+
+// Config 描述一个 public_id 的一轮完整同步：拉取远端清单 → 按协议分别 Sync。
+// 供 xraysync 与想直接嵌入同步逻辑的 Go 服务共用（零值字段即默认行为）。
+type Config struct {
+	// 远端
+	APIURL     string
+	Token      string
+	PublicID   string
+	HTTPClient *http.Client        // nil 时用 remote.NewHTTPClient(15s, "")
+	Since      time.Time           // 非零时增量拉取（增量结果按 upsert 同步，不删除）
+	FromFile   string              // 非空时不请求远端，改为读取该文件（快照 .json / .json.gz，离线重放）
+	Pushed     *remote.FetchResult // 非 nil 时直接使用（如 remote.Subscribe 推送的清单），不请求远端
+
+	// Xray 与用户默认值
+	XrayAddr     string // host:port / unix:///path；逗号分隔多个端点
+	DefaultLevel uint32
+	DefaultFlow  string            // 仅 VLESS
+	FlowMap      map[string]string // 仅 VLESS：按 tag 指定 flow（见 ApplyFlowMap）
+	PlanLevels   map[string]uint32 // 套餐 → level（见 ApplyPlanLevels）
+
+	// NormalizeEmail 为 true 时远端 email 先去首尾空白并转小写（见 NormalizeEmails）
+	NormalizeEmail bool
+	// Identity 决定 Xray 里的用户标识（add 的 email 与 remove 的键）："email"（默认）| "uuid"
+	Identity string
+
+	// DeriveUUID 为 true 时远端没给 id 的 client 用 DeriveUUID(email) 补上（否则这些 client 被忽略）
+	DeriveUUID bool
+
+	// 同步策略
+	Only        []string // 只同步这些协议（vless/vmess）；为空表示全部
+	OnlyTags    []string // 只管理这些 tag（为空表示远端给出的全部）
+	ExcludeTags []string // 不管理这些 tag（在 OnlyTags 之后生效）
+	Mode        string   // replace | upsert
+	Concurrency int
+	Reseed      bool
+	IdemMode    string // skip | success | fail
+
+	// 保护
+	AllowEmpty   bool   // 有 tag 却 0 个 client 时照常同步
+	StrictRemote bool   // 远端响应没通过 remote.Validate 时放弃本轮（默认仅告警）
+	StrictDup    bool   // 同 email 多个 id 时放弃本轮
+	StrictTags   bool   // Xray 上不存在的 tag 放弃本轮（默认剔除该 tag 并告警）
+	RequireTags  bool   // 启用的协议远端没给 tag 时记为该协议失败（默认只记日志并跳过）
+	SkipRevision string // 远端 revision 与之相同时跳过本轮（如重启后的首轮）
+
+	// 存储
+	DBV, DBM store.Store // VLESS / VMess 各自的清单
+	SnapDir  string      // 快照目录（为空不写快照）
+
+	Options SyncOptions
+}
+
+// ErrNoRemoteTags 表示远端没有给出某个启用协议的 tag（仅 Config.RequireTags 时作为错误返回）
+var ErrNoRemoteTags = errors.New("no remote tags")
+
+// ProtoResult 是单个协议的同步结果
+type ProtoResult struct {
+	Proto   string // vless | vmess
+	Tags    []string
+	Summary *Summary
+	Err     error
+}
+
+// RunResult 是 Run 一轮的结果
+type RunResult struct {
+	Revision    string              // 远端响应摘要（remote.FetchResult.Revision）
+	RunID       string              // 同一 public_id、同一远端内容与 tags 的轮次得到相同的值（下游据此去重）
+	Incremental bool                // 本轮是增量结果
+	Tags        map[string][]string // proto → 远端给出的 tags
+	Skipped     bool                // 因 SkipRevision 命中而跳过
+	Results     []ProtoResult
+}
+
+// Run 拉取一次远端清单并同步所有协议。
+// 拉取失败、被保护逻辑拦下、或任一协议 Sync 报错时返回 error（此时 RunResult 可能非 nil，含已完成的部分）。
+func Run(cfg Config) (*RunResult, error) {
+	hc := cfg.HTTPClient
+	if hc == nil {
+		var err error
+		if hc, err = remote.NewHTTPClient(15*time.Second, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	var res *remote.FetchResult
+	var err error
+	switch {
+	case cfg.Pushed != nil:
+		cfg.Options.Verbosity.infof("using pushed client list (public_id=%s incremental=%v) ...", cfg.PublicID, cfg.Pushed.Incremental)
+		res = cfg.Pushed
+	case cfg.FromFile != "":
+		// 离线重放：不写快照（那只是旧快照的副本），也不做增量
+		cfg.Options.Verbosity.infof("reading %s (public_id=%s, offline) ...", cfg.FromFile, cfg.PublicID)
+		res, err = remote.ReadFile(cfg.FromFile, false)
+	default:
+		since := "full"
+		if !cfg.Since.IsZero() {
+			since = cfg.Since.Format(time.RFC3339)
+		}
+		cfg.Options.Verbosity.infof("fetching %s (public_id=%s since=%s) ...", cfg.APIURL, cfg.PublicID, since)
+		res, err = remote.FetchWith(hc, cfg.APIURL, cfg.Token, cfg.PublicID,
+			remote.FetchOptions{KeepRaw: cfg.SnapDir != "", Since: cfg.Since})
+	}
+	if err != nil {
+		log.Printf("fetch error: %v", err)
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+	// 与 Target 同一条流水线（xrayctl diff 的预览与真正同步一致）
+	res.Clients = prepareClients(cfg, res.Clients)
+	out := &RunResult{
+		Revision:    res.Revision,
+		Incremental: res.Incremental,
+		Tags:        map[string][]string{"vless": res.TagsVLESS, "vmess": res.TagsVMESS},
+	}
+	out.RunID = runID(cfg.PublicID, res.Revision, out.Tags)
+
+	if err := checkRemote(cfg, res); err != nil {
+		return out, err
+	}
+
+	if cfg.SkipRevision != "" && cfg.SkipRevision == res.Revision {
+		log.Printf("remote unchanged since last successful sync (public_id=%s revision=%.12s); skip", cfg.PublicID, res.Revision)
+		out.Skipped = true
+		return out, nil
+	}
+
+	// 快速提示返回了什么 tags
+	cfg.Options.Verbosity.infof("remote tags (public_id=%s): vless=%v vmess=%v (clients=%d incremental=%v)",
+		cfg.PublicID, res.TagsVLESS, res.TagsVMESS, len(res.Clients), res.Incremental)
+	now := time.Now()
+	expired := 0
+	for _, c := range res.Clients {
+		if c.Expired(now) {
+			expired++
+		}
+	}
+	if expired > 0 {
+		cfg.Options.Verbosity.infof("filtered %d expired client(s) (public_id=%s)", expired, cfg.PublicID)
+	}
+
+	// 远端响应同时包含 VLESS 与 VMess：每轮只写一份快照，不再由每个协议的 Sync 各写一次
+	writeSnapshot(cfg.SnapDir, res.Raw)
+	pruneSnapshots(cfg.SnapDir, cfg.Options.SnapKeep, cfg.Options.SnapGzipAfter)
+
+	// 同一节点上多个控制器分管 inbound：只处理归本进程管的 tag
+	if len(cfg.OnlyTags) > 0 || len(cfg.ExcludeTags) > 0 {
+		res.TagsVLESS = EffectiveTags(cfg, res, "vless")
+		res.TagsVMESS = EffectiveTags(cfg, res, "vmess")
+		cfg.Options.Verbosity.infof("effective tags (public_id=%s): vless=%v vmess=%v (only=%v exclude=%v)",
+			cfg.PublicID, res.TagsVLESS, res.TagsVMESS, cfg.OnlyTags, cfg.ExcludeTags)
+	}
+
+	// Xray 上不存在的 tag：每次 add/remove 都会失败并抬高 failed，先探测一遍
+	unknown := unknownTags(cfg.Options.Pool, cfg.Options.Dial, cfg.XrayAddr, append(append([]string(nil), res.TagsVLESS...), res.TagsVMESS...))
+	if len(unknown) > 0 {
+		if cfg.StrictTags {
+			log.Printf("abort: unknown inbound tags %v on Xray(%s) (-strict-tags); skip this cycle", unknown, cfg.XrayAddr)
+			return out, fmt.Errorf("%w: %v", xray.ErrUnknownTag, unknown)
+		}
+		log.Printf("warn: unknown inbound tags %v on Xray(%s); dropped for this cycle", unknown, cfg.XrayAddr)
+	}
+
+	// 增量结果：与本地清单合并后按 upsert 同步（清单里其他用户保持不变，删除留给全量）
+	mode := cfg.Mode
+	if res.Incremental {
+		mode = "upsert"
+	}
+
+	// 先按协议准备好各自的清单，再并发同步：慢的 VMess 节点不再拖慢 VLESS
+	type job struct {
+		proto string
+		tags  []string
+		db    store.Store
+		users map[string]store.User
+	}
+	var jobs []job
+	for _, p := range []job{
+		{"vless", dropTags(res.TagsVLESS, unknown), cfg.DBV, nil},
+		{"vmess", dropTags(res.TagsVMESS, unknown), cfg.DBM, nil},
+	} {
+		if !cfg.enabled(p.proto) {
+			continue
+		}
+		// tag 只认远端给出的：没有就不碰该协议的任何 inbound
+		if len(out.Tags[p.proto]) == 0 {
+			cfg.Options.Verbosity.infof("no remote tags for %s; skipping (public_id=%s)", p.proto, cfg.PublicID)
+			if cfg.RequireTags {
+				out.Results = append(out.Results, ProtoResult{Proto: p.proto, Err: fmt.Errorf("%w for %s", ErrNoRemoteTags, p.proto)})
+			}
+			continue
+		}
+		if len(p.tags) == 0 {
+			continue // 全部 tag 都被 OnlyTags/ExcludeTags 过滤掉，或因在 Xray 上不存在而被剔除（已告警）
+		}
+		if p.db == nil {
+			p.db = store.NewMemory()
+		}
+		users := buildTarget(cfg, res.Clients, p.proto, p.tags)
+		if res.Incremental {
+			have, err := p.db.Load()
+			if err != nil {
+				return out, fmt.Errorf("db load failed: %w", err)
+			}
+			for uid, u := range have {
+				if _, ok := users[uid]; !ok {
+					users[uid] = u
+				}
+			}
+		}
+		p.users = users
+		jobs = append(jobs, p)
+	}
+
+	// 每个协议各自的 Sync（各自的 worker 与清单；连接来自 Pool 或各自拨号），结果按原顺序汇总。
+	// 限速是对 Xray 进程的保护：同一端点上两个协议共用一个限速器，而不是各限 Rate
+	if cfg.Options.Limiters == nil {
+		cfg.Options.Limiters = RateLimiters(cfg.XrayAddr, cfg.Options.Rate)
+	}
+	results := make([]ProtoResult, len(jobs))
+	var wg sync.WaitGroup
+	for i, p := range jobs {
+		wg.Add(1)
+		go func(i int, p job) {
+			defer wg.Done()
+			results[i] = runProto(cfg, p.proto, p.tags, p.users, p.db, mode)
+		}(i, p)
+	}
+	wg.Wait()
+	out.Results = append(out.Results, results...)
+
+	if len(res.TagsVLESS) == 0 && len(res.TagsVMESS) == 0 {
+		log.Printf("no tags in remote response (public_id=%s); nothing to do", cfg.PublicID)
+	}
+	for _, r := range out.Results {
+		if r.Err != nil {
+			return out, fmt.Errorf("sync %s: %w", r.Proto, r.Err)
+		}
+	}
+	return out, nil
+}
+
+// runProto 同步单个协议（在 Run 中与其他协议并发执行）
+func runProto(cfg Config, proto string, tags []string, users map[string]store.User, db store.Store, mode string) ProtoResult {
+	name := strings.ToUpper(proto)
+	cfg.Options.Verbosity.infof("sync %s → Xray(%s), tags=%v, users=%d, mode=%s, concurrency=%d, reseed=%v",
+		name, cfg.XrayAddr, tags, len(users), mode, cfg.Concurrency, cfg.Reseed)
+
+	sum, err := Sync(
+		cfg.XrayAddr,
+		tags,
+		users,
+		mode,
+		cfg.Concurrency,
+		cfg.Reseed,
+		cfg.IdemMode, // ← 幂等计数策略
+		db,
+		"", nil, // 快照已在 Run 里统一写过
+		cfg.Options,
+	)
+	if err != nil {
+		log.Printf("sync %s error: %v", name, err)
+	} else {
+		log.Printf("SYNC %s DONE: public_id=%s added=%d updated=%d removed=%d failed=%d skipped=%d (add-exist=%d, del-miss=%d)",
+			name, cfg.PublicID, sum.Added, sum.Updated, sum.Removed, sum.Failed,
+			sum.Skipped, sum.SkipAddExist, sum.SkipDelMissing,
+		)
+	}
+	return ProtoResult{Proto: proto, Tags: tags, Summary: sum, Err: err}
+}
+
+// runID 由 public_id、远端 revision 与各协议 tags（排序后）派生，重启后重跑同一份数据得到相同的值
+func runID(publicID, revision string, tags map[string][]string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", publicID, revision)
+	for _, proto := range []string{"vless", "vmess"} {
+		ts := append([]string(nil), tags[proto]...)
+		sort.Strings(ts)
+		fmt.Fprintf(h, "%s=%s\n", proto, strings.Join(ts, ","))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func (cfg *Config) enabled(proto string) bool {
+	if len(cfg.Only) == 0 {
+		return true
+	}
+	for _, p := range cfg.Only {
+		if strings.EqualFold(strings.TrimSpace(p), proto) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownTags 在每个 Xray 端点上探测 tags，返回任一端点报告不存在的 tag。
+// 连不上的端点不参与判断（交给 Sync 报错），其他探测错误也不算“不存在”。
+func unknownTags(pool *xray.Pool, dopts xray.DialOptions, xrayAddr string, tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	bad := make(map[string]bool)
+	for _, ep := range splitEndpoints(xrayAddr) {
+		cli, err := dialXray(pool, dopts, ep, tags, 5*time.Second)
+		if err != nil {
+			continue
+		}
+		for tag, err := range cli.Probe() {
+			if errors.Is(err, xray.ErrUnknownTag) {
+				bad[tag] = true
+			}
+		}
+		cli.Close()
+	}
+	var out []string
+	for _, t := range tags {
+		if bad[t] {
+			out = append(out, t)
+			delete(bad, t) // vless/vmess 共用同一个 tag 时只报一次
+		}
+	}
+	return out
+}
+
+// filterTags 返回 tags 中在 only 里（only 为空则不限）且不在 exclude 里的部分
+func filterTags(tags, only, exclude []string) []string {
+	if len(only) > 0 {
+		var keep []string
+		for _, t := range tags {
+			for _, o := range only {
+				if t == o {
+					keep = append(keep, t)
+					break
+				}
+			}
+		}
+		tags = keep
+	}
+	return dropTags(tags, exclude)
+}
+
+// dropTags 返回 tags 中不在 drop 里的部分
+func dropTags(tags, drop []string) []string {
+	if len(drop) == 0 {
+		return tags
+	}
+	var out []string
+	for _, t := range tags {
+		keep := true
+		for _, d := range drop {
+			if t == d {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// BuildUsers 把远端 client 列表转换为某个协议的目标用户集（key=UID，远端没给 uid 时用 email）。
+// 远端按用户给出的 level/flow 优先于默认值；缺 email 或 id、或已过 expires_at 的条目被忽略。
+// client 自带 tags 时只取其中属于该协议 tags 的部分；一个都不属于则该用户不进入这个协议。
+func BuildUsers(clients []remote.ClientLite, proto string, tags []string, defLevel uint32, defFlow string) map[string]store.User {
+	protoTags := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		protoTags[t] = true
+	}
+	now := time.Now()
+	out := make(map[string]store.User, len(clients))
+	for _, c := range clients {
+		if c.Email == "" || c.ID == "" || c.Expired(now) {
+			continue
+		}
+		var own []string
+		seen := make(map[string]bool, len(c.Tags))
+		for _, t := range c.Tags {
+			if t = strings.TrimSpace(t); protoTags[t] && !seen[t] {
+				seen[t] = true
+				own = append(own, t)
+			}
+		}
+		if len(c.Tags) > 0 && len(own) == 0 {
+			continue
+		}
+		if len(own) == len(tags) {
+			own = nil // 等于全部 tag：按默认处理，清单里不必逐个记录
+		}
+		uid := c.UID
+		if uid == "" {
+			uid = c.Email // 远端没给 uid 时退回以 email 作为主键
+		}
+		u := store.User{
+			UID:   uid, // 清单主键；email 改名时 uid 不变
+			Email: c.Email,
+			UUID:  c.ID,
+			Proto: proto,
+			Quota: c.Quota,
+			Note:  c.Note,
+			Tags:  own,
+			Level: defLevel,
+			Flow:  "",
+
+			ExpiresAt: c.ExpiresAt,
+		}
+		if c.Level != nil {
+			u.Level = *c.Level
+		}
+		if proto == "vless" {
+			u.Flow = defFlow // 仅 vless 有 flow 概念
+			if c.Flow != nil {
+				u.Flow = *c.Flow
+			}
+			u.Encryption = c.Encryption
+		} else {
+			u.AlterID, u.Security = c.AlterID, c.Security
+		}
+		out[uid] = u
+	}
+	return out
+}
+
+// NormalizeEmails 返回 email 去首尾空白并转小写后的 client 列表副本（Xray 按字节区分 email，A@b 与 a@b 是两个用户）。
+// 注意 email 也是删除用的键：开启前清单里大小写不同的用户会在下一轮被当作改名（删旧 email、加新 email），
+// 远端没给 uid 时主键就是 email，表现为删除旧用户并新增规范化后的用户。
+func NormalizeEmails(clients []remote.ClientLite) []remote.ClientLite {
+	out := make([]remote.ClientLite, len(clients))
+	for i, c := range clients {
+		c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+		out[i] = c
+	}
+	return out
+}
+
+// duplicateEmails 返回出现多次且 id 不同的 email → 各自的 id（按出现顺序）
+func duplicateEmails(clients []remote.ClientLite) map[string][]string {
+	ids := make(map[string][]string, len(clients))
+	for _, c := range clients {
+		if c.Email == "" || c.ID == "" {
+			continue
+		}
+		seen := false
+		for _, id := range ids[c.Email] {
+			if id == c.ID {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			ids[c.Email] = append(ids[c.Email], c.ID)
+		}
+	}
+	dups := make(map[string][]string)
+	for email, list := range ids {
+		if len(list) > 1 {
+			dups[email] = list
+		}
+	}
+	return dups
+}
@@ -0,0 +1,189 @@
+package syncer
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 快照文件名：<时间戳>.json，归档后为 <时间戳>.json.gz
+const snapLayout = "20060102-150405"
+
+// 校验文件：<时间戳>.json.sha256（sha256sum 格式，针对未压缩内容；gzip 归档后仍沿用）
+const sumSuffix = ".sha256"
+
+var (
+	// ErrNoChecksum 表示快照没有对应的 .sha256 文件（如早于校验功能引入的快照）
+	ErrNoChecksum = errors.New("snapshot checksum missing")
+	// ErrChecksumMismatch 表示快照内容与记录的 sha256 不一致（被改动或截断）
+	ErrChecksumMismatch = errors.New("snapshot checksum mismatch")
+)
+
+// writeSnapshot 保存远端原始 JSON 及其 sha256（失败仅告警，不影响主流程）
+func writeSnapshot(dir string, raw []byte) {
+	if len(raw) == 0 || dir == "" {
+		return
+	}
+	_ = os.MkdirAll(dir, 0o755)
+	name := time.Now().Format(snapLayout) + ".json"
+	fn := filepath.Join(dir, name)
+	if err := os.WriteFile(fn, raw, 0o644); err != nil {
+		log.Printf("warn: write snapshot failed: %v", err)
+		return
+	}
+	h := sha256.Sum256(raw)
+	line := hex.EncodeToString(h[:]) + "  " + name + "\n"
+	if err := os.WriteFile(fn+sumSuffix, []byte(line), 0o644); err != nil {
+		log.Printf("warn: write snapshot checksum failed: %v", err)
+	}
+}
+
+// VerifySnapshot 重新计算快照（.json 或 .json.gz）的 sha256 并与 .sha256 文件比对
+func VerifySnapshot(path string) error {
+	want, err := os.ReadFile(strings.TrimSuffix(path, ".gz") + sumSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoChecksum
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(want))
+	if len(fields) == 0 {
+		return fmt.Errorf("%w: empty checksum file", ErrChecksumMismatch)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("%w: %v", ErrChecksumMismatch, err) // gzip 截断等
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, fields[0]) {
+		return fmt.Errorf("%w: want %s got %s", ErrChecksumMismatch, fields[0], got)
+	}
+	return nil
+}
+
+type snapFile struct {
+	name string
+	ts   time.Time
+	gz   bool
+}
+
+// listSnapshots 只认“时间戳命名”的快照，其他文件（如 current.json）一律不碰
+func listSnapshots(dir string) ([]snapFile, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []snapFile
+	for _, e := range ents {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		base, gz := strings.TrimSuffix(name, ".gz"), strings.HasSuffix(name, ".gz")
+		if !strings.HasSuffix(base, ".json") {
+			continue
+		}
+		ts, err := time.ParseInLocation(snapLayout, strings.TrimSuffix(base, ".json"), time.Local)
+		if err != nil {
+			continue
+		}
+		out = append(out, snapFile{name: name, ts: ts, gz: gz})
+	}
+	// 新 → 旧
+	sort.Slice(out, func(i, j int) bool { return out[i].ts.After(out[j].ts) })
+	return out, nil
+}
+
+// pruneSnapshots 保留最新的 keep 份快照（<=0 不删），并把早于 gzipAfter 的快照压缩（<=0 不压缩）
+func pruneSnapshots(dir string, keep int, gzipAfter time.Duration) {
+	if dir == "" || (keep <= 0 && gzipAfter <= 0) {
+		return
+	}
+	snaps, err := listSnapshots(dir)
+	if err != nil {
+		log.Printf("warn: list snapshots failed: %v", err)
+		return
+	}
+
+	removed, zipped := 0, 0
+	for i, sf := range snaps {
+		path := filepath.Join(dir, sf.name)
+		if keep > 0 && i >= keep {
+			if err := os.Remove(path); err != nil {
+				log.Printf("warn: remove snapshot %s failed: %v", sf.name, err)
+			} else {
+				removed++
+				_ = os.Remove(filepath.Join(dir, strings.TrimSuffix(sf.name, ".gz")+sumSuffix))
+			}
+			continue
+		}
+		if gzipAfter > 0 && !sf.gz && time.Since(sf.ts) > gzipAfter {
+			if err := gzipFile(path); err != nil {
+				log.Printf("warn: gzip snapshot %s failed: %v", sf.name, err)
+			} else {
+				zipped++
+			}
+		}
+	}
+	if removed > 0 || zipped > 0 {
+		log.Printf("snapshots: removed=%d gzipped=%d (keep=%d)", removed, zipped, keep)
+	}
+}
+
+// gzipFile 把 path 压缩成 path.gz（先写 tmp 再 rename），成功后删除原文件
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
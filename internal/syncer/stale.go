@@ -0,0 +1,59 @@
+package syncer
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/zionnode/xray-admin/internal/store"
+)
+
+// staleRemovals 列出清单里记着的旧 email（见 store.User.StaleEmails），每个生成一条待删除的记录
+// （Email 换成旧 email）。与该用户当前 email 相同的跳过：用户改回了原名，删掉就是删掉在用的账号。
+func staleRemovals(have, want map[string]store.User) []store.User {
+	var out []store.User
+	for uid, hu := range have {
+		for _, e := range hu.StaleEmails {
+			if e == hu.Email || (want[uid].UID != "" && e == want[uid].Email) {
+				continue
+			}
+			u := hu
+			u.Email, u.StaleEmails = e, nil
+			out = append(out, u)
+		}
+	}
+	store.SortByEmail(out)
+	return out
+}
+
+// staleSet 收集本轮删除失败的旧 email（UID → email），worker 并发写入
+type staleSet struct {
+	mu sync.Mutex
+	m  map[string][]string
+}
+
+func (s *staleSet) add(uid, email string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string][]string)
+	}
+	for _, e := range s.m[uid] {
+		if e == email {
+			return
+		}
+	}
+	s.m[uid] = append(s.m[uid], email)
+}
+
+// apply 把仍未删掉的旧 email 写进待保存的清单（本轮都重试过，未失败的即已清理）。
+// 已不在清单里的用户（本轮被删除）不再跟踪。
+func (s *staleSet) apply(out map[string]store.User) {
+	for uid, u := range out {
+		u.StaleEmails = nil
+		if es := s.m[uid]; len(es) > 0 {
+			u.StaleEmails = append([]string(nil), es...)
+			sort.Strings(u.StaleEmails)
+		}
+		out[uid] = u
+	}
+}
@@ -0,0 +1,361 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+	"github.com/zionnode/xray-admin/internal/store"
+	"github.com/zionnode/xray-admin/internal/xray/xraytest"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	id1 = "11111111-1111-1111-1111-111111111111"
+	id2 = "22222222-2222-2222-2222-222222222222"
+)
+
+// fakeXray 启动带 tags 的 fake Xray，返回服务与连向它的 SyncOptions
+func fakeXray(t *testing.T, tags ...string) (*xraytest.Server, SyncOptions) {
+	t.Helper()
+	srv, err := xraytest.Start(tags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := srv.Pool()
+	t.Cleanup(func() {
+		pool.Close()
+		srv.Close()
+	})
+	return srv, SyncOptions{Pool: pool, Verbosity: VerbosityQuiet}
+}
+
+func vlessUser(uid, email, id string) store.User {
+	return store.User{UID: uid, Email: email, UUID: id, Proto: "vless"}
+}
+
+func TestSyncReseedAlreadyExists(t *testing.T) {
+	srv, opts := fakeXray(t, "a", "b")
+	db := store.NewMemory()
+	users := map[string]store.User{
+		"u1": vlessUser("u1", "u1@x", id1),
+		"u2": vlessUser("u2", "u2@x", id2),
+	}
+	if _, err := Sync(xraytest.Addr, []string{"a", "b"}, users, "replace", 4, false, "skip", db, "", nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Xray 里已经都有：reseed 的 add 全是 already exists，按各策略计数，而不是失败
+	for _, tc := range []struct {
+		idem                string
+		added, skip, failed int64
+	}{
+		{"skip", 0, 2, 0},
+		{"success", 0, 2, 0}, // reseed 时 success 也单独记为 skipped，避免 added 虚报
+		{"fail", 0, 0, 2},
+	} {
+		sum, err := Sync(xraytest.Addr, []string{"a", "b"}, users, "replace", 4, true, tc.idem, db, "", nil, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.idem, err)
+		}
+		if sum.Added != tc.added || sum.SkipAddExist != tc.skip || sum.Failed != tc.failed {
+			t.Errorf("%s: added=%d skip_add_exist=%d failed=%d, want %d/%d/%d",
+				tc.idem, sum.Added, sum.SkipAddExist, sum.Failed, tc.added, tc.skip, tc.failed)
+		}
+	}
+	for _, tag := range []string{"a", "b"} {
+		if got := srv.Users(tag); len(got) != 2 {
+			t.Errorf("users(%s) = %v, want 2", tag, got)
+		}
+	}
+}
+
+func TestSyncUpdRemovesThenAdds(t *testing.T) {
+	srv, opts := fakeXray(t, "a", "b")
+	db := store.NewMemory()
+	tags := []string{"a", "b"}
+	if _, err := Sync(xraytest.Addr, tags, map[string]store.User{"u1": vlessUser("u1", "old@x", id1)}, "replace", 2, false, "skip", db, "", nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	before := len(srv.Ops())
+
+	// 同一 UID 改了 email 和 UUID：删旧 email，再加新 email（每个 tag 上都是先删后加）
+	sum, err := Sync(xraytest.Addr, tags, map[string]store.User{"u1": vlessUser("u1", "new@x", id2)}, "replace", 2, false, "skip", db, "", nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Updated != 1 || sum.Removed != 1 || sum.Added != 1 || sum.Failed != 0 {
+		t.Errorf("summary = %+v, want updated=1 removed=1 added=1", sum)
+	}
+	ops := srv.Ops()[before:]
+	for _, tag := range tags {
+		removeAt, addAt := -1, -1
+		for i, op := range ops {
+			switch {
+			case op.Tag == tag && op.Type == "remove" && op.Email == "old@x":
+				removeAt = i
+			case op.Tag == tag && op.Type == "add" && op.Email == "new@x":
+				addAt = i
+			}
+		}
+		if removeAt < 0 || addAt < 0 || removeAt > addAt {
+			t.Errorf("tag %s: remove old@x at %d, add new@x at %d; want remove before add (ops=%+v)", tag, removeAt, addAt, ops)
+		}
+		if got := srv.Users(tag); len(got) != 1 || got[0] != "new@x" {
+			t.Errorf("users(%s) = %v, want [new@x]", tag, got)
+		}
+	}
+}
+
+// 内存库（store.NewMemory）上跑完整的 add → update → remove 一轮，不需要临时文件
+func TestSyncMemoryStoreCycle(t *testing.T) {
+	srv, opts := fakeXray(t, "a")
+	db := store.NewMemory()
+	tags := []string{"a"}
+	run := func(users map[string]store.User) *Summary {
+		t.Helper()
+		sum, err := Sync(xraytest.Addr, tags, users, "replace", 2, false, "skip", db, "", nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	check := func(step string, wantXray []string, wantDB map[string]store.User) {
+		t.Helper()
+		if got := srv.Users("a"); !equalStrings(got, wantXray) {
+			t.Errorf("%s: xray users = %v, want %v", step, got, wantXray)
+		}
+		have, err := db.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(have) != len(wantDB) {
+			t.Errorf("%s: db has %d users, want %d", step, len(have), len(wantDB))
+		}
+		for uid, w := range wantDB {
+			if h, ok := have[uid]; !ok || !store.Equal(h, w) {
+				t.Errorf("%s: db[%s] = %+v, want %+v", step, uid, h, w)
+			}
+		}
+	}
+
+	u1, u2 := vlessUser("u1", "u1@x", id1), vlessUser("u2", "u2@x", id2)
+	if sum := run(map[string]store.User{"u1": u1, "u2": u2}); sum.Added != 2 {
+		t.Errorf("add: added = %d, want 2", sum.Added)
+	}
+	check("add", []string{"u1@x", "u2@x"}, map[string]store.User{"u1": u1, "u2": u2})
+
+	u1.Level = 2
+	if sum := run(map[string]store.User{"u1": u1, "u2": u2}); sum.Updated != 1 || sum.Added != 1 || sum.Removed != 1 {
+		t.Errorf("update: %+v, want updated=1 (remove+add)", sum)
+	}
+	check("update", []string{"u1@x", "u2@x"}, map[string]store.User{"u1": u1, "u2": u2})
+
+	if sum := run(map[string]store.User{"u1": u1}); sum.Removed != 1 {
+		t.Errorf("remove: removed = %d, want 1", sum.Removed)
+	}
+	check("remove", []string{"u1@x"}, map[string]store.User{"u1": u1})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// -rate 限的是一个 Xray 端点承受的速率：Run 里 VLESS 与 VMess 并发同步时共用同一个限速器
+func TestRunRateSharedAcrossProtos(t *testing.T) {
+	_, opts := fakeXray(t, "v", "m")
+	opts.Rate = 20 // 每 50ms 一次
+	res := &remote.FetchResult{TagsVLESS: []string{"v"}, TagsVMESS: []string{"m"}}
+	for i := 0; i < 5; i++ {
+		res.Clients = append(res.Clients, remote.ClientLite{ID: id1, Email: fmt.Sprintf("u%d@x", i)})
+	}
+
+	start := time.Now()
+	out, err := Run(Config{Pushed: res, XrayAddr: xraytest.Addr, Mode: "replace", Concurrency: 4, Options: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	for _, r := range out.Results {
+		if r.Summary.Added != 5 {
+			t.Fatalf("%s added = %d, want 5", r.Proto, r.Summary.Added)
+		}
+	}
+	// 共 10 次调用：共用一个限速器至少 9×50ms；各协议各自限速只需 4×50ms
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("10 calls at rate 20/s took %s; protos are not sharing one limiter", elapsed)
+	}
+}
+
+// 失败明细按 tag 拆开并带上 gRPC code（TagErrors 本身没有 GRPCStatus）
+func TestSyncFailureDetailCode(t *testing.T) {
+	srv, opts := fakeXray(t, "a", "b")
+	srv.Fail = func(op, tag, email string) error {
+		if tag == "b" {
+			return status.Error(codes.PermissionDenied, "denied on b")
+		}
+		return nil
+	}
+	users := map[string]store.User{"u1": vlessUser("u1", "u1@x", id1)}
+	sum, err := Sync(xraytest.Addr, []string{"a", "b"}, users, "replace", 1, false, "skip", store.NewMemory(), "", nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Failed != 1 || len(sum.Failures) != 1 {
+		t.Fatalf("failed=%d failures=%+v, want one failure", sum.Failed, sum.Failures)
+	}
+	f := sum.Failures[0]
+	if f.Op != "add" || f.Tag != "b" || f.Code != codes.PermissionDenied.String() || f.Msg != "denied on b" {
+		t.Errorf("failure = %+v, want add on tag b with code PermissionDenied", f)
+	}
+}
+
+// 限速排队受整轮超时约束：到期即中止，而不是把排队时间叠加到 -sync-timeout 之上
+func TestSyncTimeoutInterruptsRateWait(t *testing.T) {
+	_, opts := fakeXray(t, "a")
+	opts.Rate = 2 // 每 500ms 一次：5 个用户要 2s
+	opts.Timeout = 300 * time.Millisecond
+	users := map[string]store.User{}
+	for i := 0; i < 5; i++ {
+		uid := fmt.Sprintf("u%d", i)
+		users[uid] = vlessUser(uid, uid+"@x", id1)
+	}
+	db := store.NewMemory()
+
+	start := time.Now()
+	sum, err := Sync(xraytest.Addr, []string{"a"}, users, "replace", 5, false, "skip", db, "", nil, opts)
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrSyncTimeout) || !sum.TimedOut {
+		t.Fatalf("err = %v timed_out = %v, want ErrSyncTimeout", err, sum.TimedOut)
+	}
+	if elapsed > time.Second {
+		t.Errorf("sync took %s with timeout %s; rate wait ignores ctx", elapsed, opts.Timeout)
+	}
+	if have, _ := db.Load(); len(have) != 0 {
+		t.Errorf("manifest saved %d users after timeout", len(have))
+	}
+}
+
+// -atomic-add 跨 flow 分组成立：后一组真正失败时，前一组已加上的 tag 也要撤回
+func TestSyncAtomicAddAcrossFlowGroups(t *testing.T) {
+	for _, atomicAdd := range []bool{false, true} {
+		srv, opts := fakeXray(t, "plain", "vision")
+		opts.AtomicAdd = atomicAdd
+		srv.Fail = func(op, tag, email string) error {
+			if op == "add" && tag == "vision" {
+				return status.Error(codes.Internal, "boom")
+			}
+			return nil
+		}
+		u := vlessUser("u1", "u1@x", id1)
+		u.TagFlows = map[string]string{"vision": "xtls-rprx-vision"} // plain 与 vision 分两组下发
+		sum, err := Sync(xraytest.Addr, []string{"plain", "vision"}, map[string]store.User{"u1": u}, "replace", 1, false, "skip", store.NewMemory(), "", nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum.Failed != 1 {
+			t.Errorf("atomic=%v: failed = %d, want 1", atomicAdd, sum.Failed)
+		}
+		want := []string{"u1@x"} // 非原子：plain 上保留
+		if atomicAdd {
+			want = nil
+		}
+		if got := srv.Users("plain"); !equalStrings(got, want) {
+			t.Errorf("atomic=%v: users(plain) = %v, want %v", atomicAdd, got, want)
+		}
+	}
+}
+
+// 被删除保护或确认中止的一轮不落盘任何状态（包括配额禁用集合）；正常完成时禁用集合随清单一起保存
+func TestSyncAbortKeepsDisabledSet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.json")
+	db, err := store.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := map[string]store.User{
+		"u1": vlessUser("u1", "u1@x", id1),
+		"u2": vlessUser("u2", "u2@x", id2),
+		"u3": vlessUser("u3", "u3@x", id2),
+	}
+	_ = db.SetDisabled(map[string]int64{"u1": 100})
+	if err := db.Save(have); err != nil {
+		t.Fatal(err)
+	}
+	// 远端清掉了 u1 的配额（会解禁），同时只剩 u1（要删 u2、u3）
+	want := map[string]store.User{"u1": have["u1"]}
+	onDisk := func() map[string]int64 {
+		t.Helper()
+		d, err := store.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Disabled()
+	}
+
+	for _, tc := range []struct {
+		name  string
+		setup func(*SyncOptions)
+		want  error
+	}{
+		{"max removals", func(o *SyncOptions) { o.MaxRemovals = RemovalLimit{Count: 1} }, ErrTooManyRemovals},
+		{"not confirmed", func(o *SyncOptions) {
+			o.ConfirmRemovals = func([]string, []store.User) bool { return false }
+		}, ErrRemovalsNotConfirmed},
+	} {
+		_, opts := fakeXray(t, "a")
+		opts.EnforceQuota = true
+		tc.setup(&opts)
+		if _, err := Sync(xraytest.Addr, []string{"a"}, want, "replace", 1, false, "skip", db, "", nil, opts); !errors.Is(err, tc.want) {
+			t.Fatalf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+		if got := onDisk(); got["u1"] != 100 {
+			t.Errorf("%s: disabled on disk = %v, want unchanged", tc.name, got)
+		}
+	}
+
+	_, opts := fakeXray(t, "a")
+	opts.EnforceQuota = true
+	if _, err := Sync(xraytest.Addr, []string{"a"}, want, "replace", 1, false, "skip", db, "", nil, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := onDisk(); len(got) != 0 {
+		t.Errorf("disabled on disk = %v, want u1 released", got)
+	}
+}
+
+// 删除时 tag 不存在（找不到 inbound handler）不是幂等的“用户已不在”，要计为失败
+func TestSyncRemoveOnMissingTagFails(t *testing.T) {
+	_, opts := fakeXray(t, "a") // 没有 ghost
+	db := store.NewMemory()
+	if err := db.Save(map[string]store.User{"u1": vlessUser("u1", "u1@x", id1)}); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := Sync(xraytest.Addr, []string{"a", "ghost"}, map[string]store.User{}, "replace", 1, false, "skip", db, "", nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Failed != 1 || sum.SkipDelMissing != 0 || sum.Removed != 0 {
+		t.Errorf("summary = %+v, want the removal on the missing tag counted as failed", sum)
+	}
+	ghost := false
+	for _, f := range sum.Failures {
+		ghost = ghost || f.Tag == "ghost"
+	}
+	if !ghost {
+		t.Errorf("failures = %+v, want one on tag ghost", sum.Failures)
+	}
+}
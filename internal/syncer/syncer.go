@@ -1,10 +1,11 @@
 package syncer
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
+	"log/slog"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -13,56 +14,212 @@ import (
 	"github.com/zionnode/xray-admin/internal/store"
 	"github.com/zionnode/xray-admin/internal/xray"
 
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 // Summary 用于最终统计输出
+// （json 字段名是对外约定，webhook 等下游会解析，勿随意改动）
 type Summary struct {
-	Added, Updated, Removed, Failed int64
+	Added   int64 `json:"added"`
+	Updated int64 `json:"updated"`
+	Removed int64 `json:"removed"`
+	Failed  int64 `json:"failed"`
 
 	// 幂等统计（不算入 Added/Removed/Failed）：
-	SkipAddExist   int64 // add 时 already exists
-	SkipDelMissing int64 // del/upd-remove 时 not found
+	SkipAddExist   int64 `json:"skip_add_exist"`   // add 时 already exists
+	SkipDelMissing int64 `json:"skip_del_missing"` // del/upd-remove 时 not found
+	Skipped        int64 `json:"skipped"`          // 上面两项之和（与 SYNC SUMMARY 的 skipped 一致）
+
+	Disabled int64 `json:"disabled"` // 本轮因超配额新禁用的用户数（EnforceQuota）
+
+	// Latency 是本轮 Add/Remove 调用的耗时分位数（没有调用时为空）
+	Latency *LatencyStats `json:"latency,omitempty"`
+
+	// TimedOut 表示本轮超过 SyncOptions.Timeout 被中止（计数只含已完成的部分）
+	TimedOut bool `json:"timed_out,omitempty"`
+
+	// Changes 是本轮生效的 email（仅 SyncOptions.RecordChanges 时填充）
+	Changes *Changes `json:"changes,omitempty"`
+
+	// Failures 是失败操作的明细（最多 SyncOptions.MaxFailures 条，超出的只计入 FailuresDropped）
+	Failures        []FailureDetail `json:"failures,omitempty"`
+	FailuresDropped int64           `json:"failures_dropped,omitempty"`
+
+	// 多端点时每个端点各自的统计（上面的计数是它们的合计）；单端点时为空
+	Endpoints map[string]*Summary `json:"endpoints,omitempty"`
+	// 仅出现在 Endpoints 的条目里：该端点连接失败的原因（此时 Failed 计为全部任务数）
+	Error string `json:"error,omitempty"`
+}
+
+// ErrUnsupportedProto 表示用户的 proto 不是 vless/vmess（返回时会包装上具体值，用 errors.Is 判断）
+var ErrUnsupportedProto = errors.New("unsupported proto")
+
+// ErrSyncTimeout 表示整轮同步超过 SyncOptions.Timeout（返回时 Summary.TimedOut 为 true）
+var ErrSyncTimeout = errors.New("sync timed out")
+
+// RetryPolicy 控制单次 Add/Remove 失败后的重试
+type RetryPolicy struct {
+	Attempts  int           // 总尝试次数（含首次），<=0 视为 1
+	BaseDelay time.Duration // 第 i 次重试前等待 BaseDelay*i
+	Max       time.Duration // 单次等待上限（0 表示不封顶）
+}
+
+// DefaultRetry 3 次尝试，200ms 线性递增，最多等 2s
+var DefaultRetry = RetryPolicy{Attempts: 3, BaseDelay: 200 * time.Millisecond, Max: 2 * time.Second}
+
+// SyncOptions 是 Sync 的可选项（零值即默认行为）
+type SyncOptions struct {
+	Retry RetryPolicy // Add/Remove 的重试策略（只重试瞬时 gRPC 错误；零值只试一次）
+
+	SnapKeep      int           // 只保留最新 N 份快照（<=0 不清理）
+	SnapGzipAfter time.Duration // 早于该时长的快照 gzip 归档（<=0 不压缩）
+
+	// 按操作类型的并发上限（<=0 沿用 concurrency）：add 较重（如 Vision），del 较轻
+	ConcurrencyAdd int
+	ConcurrencyDel int
+
+	// MaxRemovals 限制单轮计划删除数，超出则整轮放弃并返回 ErrTooManyRemovals
+	MaxRemovals RemovalLimit
+
+	// ConfirmRemovals 非 nil 时，本轮有计划删除（含超配额删除）就先调用它；返回 false 则整轮放弃、
+	// 不写盘，并返回 ErrRemovalsNotConfirmed。供交互式确认使用，多个 Sync 可能并发调用。
+	ConfirmRemovals func(tags []string, dels []store.User) bool
+
+	// EnforceQuota 为 true 时按 User.Quota 检查 Xray 的用户流量统计，
+	// 超额用户移出 inbound 并记入清单的禁用集合，直到远端把配额清零。
+	EnforceQuota bool
+
+	// AutoConcurrency 为 true 时在途任务数自适应：从较低值起步，无错误时逐步加到 worker 上限，
+	// 出现 Unavailable/ResourceExhausted/DeadlineExceeded 时减半（每个端点各自调整）
+	AutoConcurrency bool
+
+	// Rate 限制每秒发往每个 Xray 端点的 AlterInbound 次数（每个 tag 算一次，所有 worker 共享；<=0 不限）
+	Rate float64
+	// Limiters 按端点给出共享的限速器（优先于 Rate）：Run 为每个端点建一个，让 VLESS 与 VMess 的 Sync 共用，
+	// 端点实际承受的仍是 Rate。为 nil 或缺某个端点时，该端点按 Rate 在本次 Sync 内单独限速。
+	Limiters map[string]*rate.Limiter
+
+	// AtomicAdd 为 true 时，多 tag 的 Add 只要有 tag 真正失败就撤回已成功的 tag（记一次失败），
+	// 避免用户只存在于部分 inbound 上
+	AtomicAdd bool
+
+	// RemoveGrace>0 时 replace 模式的删除先暂缓：用户在清单里标记 MissingSince，
+	// 连续缺席满该时长才真正删除，期间重新出现则不做任何操作（避免上游短暂抖动导致删了又加）
+	RemoveGrace time.Duration
+
+	// Timeout 限制整轮 Sync 的耗时（<=0 不限）。超时后不再处理剩余任务、取消进行中的 RPC 与限速排队，
+	// 返回已完成部分的 Summary（TimedOut=true）与 ErrSyncTimeout，且不写回清单（下一轮重新规划）。
+	Timeout time.Duration
+
+	// Context 是整轮 Sync 的父 context（nil 即 Background）；取消后与超时一样中止本轮、不写回清单
+	Context context.Context
+
+	// Pool 非 nil 时从中取复用的连接（常驻进程跨轮保持连接），否则每次 Sync 各自拨号、结束时关闭
+	Pool *xray.Pool
+
+	// Dial 是不用 Pool 时新拨号的 gRPC 连接参数（用 Pool 时以 Pool.Options 为准）
+	Dial xray.DialOptions
+
+	// RecordChanges 为 true 时在 Summary.Changes 里记录生效的 email（大清单时占内存，默认关闭）
+	RecordChanges bool
+
+	// MaxFailures 限制 Summary.Failures 保留的条数（0 即 DefaultMaxFailures，<0 不保留明细）
+	MaxFailures int
+
+	// Verbosity 控制过程日志的多少（quiet 时不打印进度与幂等跳过，verbose 时逐个打印成功操作）
+	Verbosity Verbosity
+
+	// Progress 在每个进度里程碑（每 200 个任务及最后一个）被调用；为 nil 时打印 progress 日志。
+	// 会在 worker goroutine 中并发调用，实现方需自行保证并发安全。
+	Progress func(done, total int64, s Summary)
 }
 
 // Sync
-// - xrayAddr: gRPC 地址（host:port）
+// - xrayAddr: gRPC 地址（host:port）；逗号分隔多个时按集群处理，逐端点下发同一计划
 // - tags:     目标 inbound tag 列表（本次只对这些 tag 同步）
-// - users:    远端“权威清单”，key=UID（email），value=User
+// - users:    远端“权威清单”，key=UID（远端 uid，缺省为 email），value=User
 // - mode:     "replace" | "upsert"
 // - concurrency: worker 并发
 // - reseed:   true 时对 users 中所有用户执行一次 Add（已存在跳过），不做删除
 // - idemMode: "skip"(默认) | "success" | "fail" —— 幂等情况的计数策略
-// - db:       本地 DB（保存权威清单）
-// - snapDir/raw: 保存原始快照
+// - db:       本地清单（文件版 store.Open 或内存版 store.NewMemory）
+// - snapDir/raw: 保存原始快照（snapDir 为空时不写快照、不建目录、不清理）
+// - opts:     可选项（重试、快照保留、进度回调）
 func Sync(xrayAddr string, tags []string, users map[string]store.User,
 	mode string, concurrency int, reseed bool,
 	idemMode string,
-	db *store.DB, snapDir string, raw []byte,
+	db store.Store, snapDir string, raw []byte,
+	opts SyncOptions,
 ) (*Summary, error) {
 
 	sum := &Summary{}
+	defer func() { sum.Skipped = sum.SkipAddExist + sum.SkipDelMissing }()
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	// 1) 快照落盘 + 清理旧快照（尽量不影响主流程，失败仅告警）
+	writeSnapshot(snapDir, raw)
+	pruneSnapshots(snapDir, opts.SnapKeep, opts.SnapGzipAfter)
 
-	// 1) 快照落盘（尽量不影响主流程，失败仅告警）
-	if len(raw) > 0 && snapDir != "" {
-		_ = os.MkdirAll(snapDir, 0o755)
-		fn := filepath.Join(snapDir, time.Now().Format("20060102-150405")+".json")
-		if err := os.WriteFile(fn, raw, 0o644); err != nil {
-			log.Printf("warn: write snapshot failed: %v", err)
+	// 用户自带 Tags（按用户指定 inbound）时只作用于这些 tag，否则作用于本次全部 tags
+	tagsFor := func(u store.User) []string {
+		if len(u.Tags) > 0 {
+			return u.Tags
 		}
+		return tags
 	}
 
 	// 2) 打开 Xray 客户端
 	if len(tags) == 0 {
-		log.Printf("no tags to sync, skip")
+		opts.Verbosity.infof("no tags to sync, skip")
 		return sum, nil
 	}
-	cli, err := xray.NewClient(xrayAddr, tags, 15*time.Second)
-	if err != nil {
-		return sum, fmt.Errorf("dial xray %s failed: %w", xrayAddr, err)
+	// xrayAddr 可逗号分隔多个端点（同构节点集群）：同一份计划分别下发到每个端点，
+	// 某个端点连不上不影响其他端点，全部连不上才返回错误
+	endpoints := splitEndpoints(xrayAddr)
+	clis := make([]*xray.Client, len(endpoints))
+	dialErrs := make([]error, len(endpoints))
+	var live []*xray.Client
+	for i, ep := range endpoints {
+		cli, err := dialXray(opts.Pool, opts.Dial, ep, tags, 15*time.Second)
+		if err != nil {
+			dialErrs[i] = fmt.Errorf("dial xray %s failed: %w", ep, err)
+			continue
+		}
+		defer cli.Close()
+		// "success" 策略下“删除不存在的用户”本就算成功，直接在客户端按 tag 忽略 NotFound；
+		// 其余策略仍需要原始错误来单独计数（skip）或计为失败（fail）
+		cli.IgnoreNotFound = idemMode == "success"
+		cli.Context = ctx
+		cli.AtomicAdd = opts.AtomicAdd
+		rl := opts.Limiters[ep]
+		if rl == nil {
+			rl = NewRateLimiter(opts.Rate)
+		}
+		if rl != nil {
+			cli.Throttle = throttle(rl) // 限速按端点各自计算
+		}
+		clis[i] = cli
+		live = append(live, cli)
+	}
+	if len(live) == 0 {
+		return sum, errors.Join(dialErrs...)
+	}
+	for _, err := range dialErrs {
+		if err != nil {
+			log.Printf("warn: %v (other endpoints continue; run -reseed once it is back)", err)
+		}
 	}
-	defer cli.Close()
 
 	// 3) 读取本地权威清单
 	have, err := db.Load()
@@ -70,251 +227,686 @@ func Sync(xrayAddr string, tags []string, users map[string]store.User,
 		return sum, fmt.Errorf("db load failed: %w", err)
 	}
 
+	// 3.5) 配额：超额/仍禁用的用户不进入目标集合，已下发的强制删除
+	var quotaDels []store.User
+	var disabled map[string]int64 // 新的禁用集合：通过删除保护与确认后才随清单一起保存
+	if opts.EnforceQuota {
+		users, quotaDels, disabled, sum.Disabled = applyQuota(live, db, users, have)
+	}
+	save := func(m map[string]store.User) {
+		if disabled != nil {
+			if err := db.SetDisabled(disabled); err != nil {
+				log.Printf("warn: set disabled users failed: %v", err)
+			}
+		}
+		if err := db.Save(m); err != nil {
+			log.Printf("warn: db save failed: %v", err)
+		}
+	}
+
 	// 4) 计算差异
 	adds, upds, dels := plan(have, users, mode, reseed)
 
-	totalJobs := len(adds) + len(upds) + len(dels)
+	// 4.2) 删除宽限：暂缓的用户留在目标集合里一起写回清单
+	if opts.RemoveGrace > 0 && len(dels) > 0 {
+		var pending int
+		if dels, users, pending = deferRemovals(dels, users, quotaDels, opts.RemoveGrace, time.Now().UTC()); pending > 0 {
+			opts.Verbosity.infof("deferred %d removal(s) within remove grace %s", pending, opts.RemoveGrace)
+		}
+	}
+
+	// 4.5) 删除数保护：远端异常（如返回近乎空的列表）时不执行、不写盘
+	if opts.MaxRemovals.exceeded(len(dels), len(have)) {
+		const preview = 20
+		for i, u := range dels {
+			if i == preview {
+				log.Printf("ABORT would-delete ... and %d more", len(dels)-preview)
+				break
+			}
+			log.Printf("ABORT would-delete proto=%s uid=%s email=%s", u.Proto, u.UID, u.Email)
+		}
+		return sum, fmt.Errorf("%w: planned=%d have=%d limit=%s", ErrTooManyRemovals, len(dels), len(have), opts.MaxRemovals)
+	}
+	dels = mergeDels(dels, quotaDels) // 超配额是主动禁用，不计入删除保护
+	if opts.ConfirmRemovals != nil && len(dels) > 0 && !opts.ConfirmRemovals(tags, dels) {
+		log.Printf("ABORT %d removal(s) not confirmed (tags=%v); nothing applied", len(dels), tags)
+		return sum, fmt.Errorf("%w: planned=%d", ErrRemovalsNotConfirmed, len(dels))
+	}
+
+	// 4.6) 以前改名时没删掉的旧 email：每轮重试（删除仍失败的会再次记入清单）
+	staleDels := staleRemovals(have, users)
+	stale := &staleSet{}
+
+	var changes *changeLog
+	if opts.RecordChanges {
+		changes = &changeLog{}
+	}
+	totalJobs := len(adds) + len(upds) + len(dels) + len(staleDels)
 	if totalJobs == 0 {
-		log.Printf("nothing to do (adds=0 upds=0 dels=0)")
+		opts.Verbosity.infof("nothing to do (adds=0 upds=0 dels=0)")
+		sum.Changes = changes.result()
 		// 仍然写回“最新权威清单”
-		if err := db.Save(users); err != nil {
-			log.Printf("warn: db save failed: %v", err)
-		}
+		save(stamp(have, users, time.Now().UTC()))
 		return sum, nil
 	}
 
-	log.Printf("plan: adds=%d upds=%d dels=%d (mode=%s reseed=%v)", len(adds), len(upds), len(dels), mode, reseed)
+	opts.Verbosity.info(slog.Default(), "plan", "tags", tags, "adds", len(adds), "upds", len(upds), "dels", len(dels), "stale", len(staleDels), "mode", mode, "reseed", reseed)
 
 	// 5) 并发执行
 	type job struct {
-		typ string     // "add" | "del" | "upd"
+		typ string     // "add" | "del" | "upd" | "stale"（删除旧 email）
 		u   store.User // upd 也要带上用户，便于日志/分类
+		old store.User // 仅 upd：清单里的旧记录（email 可能已改名，删除要用旧 email）
 	}
 
-	jobCh := make(chan job, totalJobs)
-	var wg sync.WaitGroup
+	// 每个端点各自一套 worker 与计数；进度按所有端点合计
+	epSums := make([]*Summary, len(endpoints))
+	for i := range epSums {
+		epSums[i] = &Summary{}
+	}
+	current := func() Summary {
+		var out Summary
+		for _, es := range epSums {
+			out.add(es.load())
+		}
+		return out
+	}
+	total := int64(totalJobs * len(live))
 	var done int64
+	lat := &latencyRecorder{}
+	failures := newFailureLog(opts.MaxFailures)
+
+	runOn := func(cli *xray.Client, sum *Summary, lg *slog.Logger, ep string) {
+		jobCh := make(chan job, totalJobs)
+		var wg sync.WaitGroup
+
+		// 幂等识别 + 计数
+		recordFail := func(op string, u store.User, err error) {
+			atomic.AddInt64(&sum.Failed, 1)
+			failures.add(op, u, ep, err)
+			// 尽力打印出 gRPC code
+			if st, ok := status.FromError(err); ok {
+				lg.Warn("FAIL", "op", op, "proto", u.Proto, "uid", u.UID, "email", u.Email,
+					"code", st.Code().String(), "msg", st.Message())
+			} else {
+				lg.Warn("FAIL", "op", op, "proto", u.Proto, "uid", u.UID, "email", u.Email,
+					"tags_failed", failedTags(err, len(tagsFor(u))), "tags", len(tagsFor(u)), "err", err.Error())
+			}
+		}
 
-	// 幂等识别 + 计数
-	recordFail := func(op string, u store.User, err error) {
-		atomic.AddInt64(&sum.Failed, 1)
-		// 尽力打印出 gRPC code
-		if st, ok := status.FromError(err); ok {
-			log.Printf("FAIL op=%s proto=%s uid=%s email=%s code=%s msg=%q",
-				op, u.Proto, u.UID, u.Email, st.Code(), st.Message())
-		} else {
-			log.Printf("FAIL op=%s proto=%s uid=%s email=%s err=%v",
-				op, u.Proto, u.UID, u.Email, err)
+		// reseed 时绝大多数 add 都是 already exists：即使 "success" 策略也单独计为 skipped，
+		// 否则 added 会虚报成整个目标集合的大小
+		addIdem := idemMode
+		if reseed && addIdem == "success" {
+			addIdem = "skip"
 		}
-	}
 
-	handleIdempotent := func(kind string, u store.User, err error) bool {
-		// 返回 true 表示“此错误已处理完毕（按 skip/success 策略计数），外层无需再按失败处理”
-		if err == nil {
+		handleIdempotent := func(kind string, u store.User, err error) bool {
+			// 返回 true 表示“此错误已处理完毕（按 skip/success 策略计数），外层无需再按失败处理”
+			if err == nil {
+				return false
+			}
+			// 多 tag 时：部分 tag 成功、其余 tag 全是幂等错误 → 用户已收敛，按真实成功计（"fail" 策略除外）
+			n := len(tagsFor(u))
+			partial := idemMode != "fail" && failedTags(err, n) < n
+			if kind == "add" && isAlreadyExists(err) {
+				if partial {
+					atomic.AddInt64(&sum.Added, 1)
+					opts.Verbosity.info(lg, "OK", "op", "add-partial-exist", "proto", u.Proto, "uid", u.UID, "email", u.Email)
+					return true
+				}
+				switch addIdem {
+				case "skip":
+					atomic.AddInt64(&sum.SkipAddExist, 1)
+					opts.Verbosity.info(lg, "SKIP", "op", "add", "proto", u.Proto, "uid", u.UID, "email", u.Email, "reason", "already_exists")
+					return true
+				case "success":
+					atomic.AddInt64(&sum.Added, 1)
+					opts.Verbosity.info(lg, "OK", "op", "add-exist", "proto", u.Proto, "uid", u.UID, "email", u.Email)
+					return true
+				}
+				// "fail": 继续外层失败计数
+			}
+			if (kind == "del" || kind == "upd-remove" || kind == "del-stale") && isNotFound(err) {
+				if partial {
+					atomic.AddInt64(&sum.Removed, 1)
+					opts.Verbosity.info(lg, "OK", "op", kind+"-partial-miss", "proto", u.Proto, "uid", u.UID, "email", u.Email)
+					return true
+				}
+				switch idemMode {
+				case "skip":
+					atomic.AddInt64(&sum.SkipDelMissing, 1)
+					opts.Verbosity.info(lg, "SKIP", "op", kind, "proto", u.Proto, "uid", u.UID, "email", u.Email, "reason", "not_found")
+					return true
+				case "success":
+					atomic.AddInt64(&sum.Removed, 1)
+					opts.Verbosity.info(lg, "OK", "op", kind+"-miss", "proto", u.Proto, "uid", u.UID, "email", u.Email)
+					return true
+				}
+				// "fail": 继续外层失败计数
+			}
 			return false
 		}
-		if kind == "add" && isAlreadyExists(err) {
-			switch idemMode {
-			case "skip":
-				atomic.AddInt64(&sum.SkipAddExist, 1)
-				log.Printf("SKIP op=add proto=%s uid=%s email=%s reason=already_exists", u.Proto, u.UID, u.Email)
-				return true
-			case "success":
-				atomic.AddInt64(&sum.Added, 1)
-				log.Printf("OK(op=add-exist) proto=%s uid=%s email=%s", u.Proto, u.UID, u.Email)
-				return true
-			}
-			// "fail": 继续外层失败计数
+
+		// 按操作类型分别限流（upd 的两步各自占用 del/add 名额）；worker 数取三者最大值
+		if concurrency <= 0 {
+			concurrency = 1
 		}
-		if (kind == "del" || kind == "upd-remove") && isNotFound(err) {
-			switch idemMode {
-			case "skip":
-				atomic.AddInt64(&sum.SkipDelMissing, 1)
-				log.Printf("SKIP op=%s proto=%s uid=%s email=%s reason=not_found", kind, u.Proto, u.UID, u.Email)
-				return true
-			case "success":
-				atomic.AddInt64(&sum.Removed, 1)
-				log.Printf("OK(op=%s-miss) proto=%s uid=%s email=%s", kind, u.Proto, u.UID, u.Email)
-				return true
+		addLimit, delLimit := concurrency, concurrency
+		if opts.ConcurrencyAdd > 0 {
+			addLimit = opts.ConcurrencyAdd
+		}
+		if opts.ConcurrencyDel > 0 {
+			delLimit = opts.ConcurrencyDel
+		}
+		workers := concurrency
+		if addLimit > workers {
+			workers = addLimit
+		}
+		if delLimit > workers {
+			workers = delLimit
+		}
+		addSem := make(chan struct{}, addLimit)
+		delSem := make(chan struct{}, delLimit)
+		var auto *adaptiveLimiter
+		if opts.AutoConcurrency {
+			auto = newAdaptiveLimiter(autoStart, workers)
+		}
+
+		addUser := func(u store.User) error {
+			addSem <- struct{}{}
+			defer func() { <-addSem }()
+			if u.Proto != "vless" && u.Proto != "vmess" {
+				return fmt.Errorf("%w: %q", ErrUnsupportedProto, u.Proto)
 			}
-			// "fail": 继续外层失败计数
+			return withRetry(ctx, opts.Retry, isAlreadyExists, func() (err error) {
+				defer func(start time.Time) { lat.observe(time.Since(start)); auto.observe(err) }(time.Now())
+				if u.Proto == "vless" {
+					return addVLESS(cli, tagsFor(u), u)
+				}
+				return cli.AddVMessToTags(tagsFor(u), u.Email, u.UUID, u.Level, u.AlterID, u.Security)
+			})
+		}
+		removeUser := func(u store.User) error {
+			delSem <- struct{}{}
+			defer func() { <-delSem }()
+			return withRetry(ctx, opts.Retry, isNotFound, func() (err error) {
+				defer func(start time.Time) { lat.observe(time.Since(start)); auto.observe(err) }(time.Now())
+				return cli.RemoveFromTags(u.Email, tagsFor(u))
+			})
 		}
-		return false
-	}
 
-	worker := func() {
-		defer wg.Done()
-		for j := range jobCh {
-			switch j.typ {
-			case "add":
-				var err error
-				if j.u.Proto == "vless" {
-					err = cli.AddVLESS(j.u.Email, j.u.UUID, j.u.Level, j.u.Flow)
-				} else {
-					err = cli.AddVMess(j.u.Email, j.u.UUID, j.u.Level)
+		worker := func() {
+			defer wg.Done()
+			for j := range jobCh {
+				if ctx.Err() != nil {
+					continue // 已超时：丢弃剩余任务（jobCh 有足够缓冲，投递方不会被卡住）
 				}
-				if err != nil {
-					if !handleIdempotent("add", j.u, err) {
-						recordFail("add", j.u, err)
+				auto.acquire()
+				switch j.typ {
+				case "add":
+					if err := addUser(j.u); err != nil {
+						if !handleIdempotent("add", j.u, err) {
+							recordFail("add", j.u, err)
+						}
+					} else {
+						atomic.AddInt64(&sum.Added, 1)
+						changes.added(j.u.Email)
+						opts.Verbosity.detail(lg, "OK", "op", "add", "proto", j.u.Proto, "uid", j.u.UID, "email", j.u.Email)
 					}
-				} else {
-					atomic.AddInt64(&sum.Added, 1)
-				}
 
-			case "del":
-				if err := cli.Remove(j.u.Email); err != nil {
-					if !handleIdempotent("del", j.u, err) {
-						recordFail("del", j.u, err)
+				case "del":
+					if err := removeUser(j.u); err != nil {
+						if !handleIdempotent("del", j.u, err) {
+							recordFail("del", j.u, err)
+						}
+					} else {
+						atomic.AddInt64(&sum.Removed, 1)
+						changes.removed(j.u.Email)
+						opts.Verbosity.detail(lg, "OK", "op", "del", "proto", j.u.Proto, "uid", j.u.UID, "email", j.u.Email)
 					}
-				} else {
-					atomic.AddInt64(&sum.Removed, 1)
-				}
 
-			case "upd":
-				// 先删后加（两步各自应用幂等策略）
-				if err := cli.Remove(j.u.Email); err != nil {
-					if !handleIdempotent("upd-remove", j.u, err) {
-						recordFail("upd-remove", j.u, err)
+				case "upd":
+					// 先删旧再加新（两步各自应用幂等策略）
+					if err := removeUser(j.old); err != nil {
+						if !handleIdempotent("upd-remove", j.old, err) {
+							recordFail("upd-remove", j.old, err)
+							if j.old.Email != j.u.Email {
+								stale.add(j.u.UID, j.old.Email) // 清单即将只记新 email：旧的另记下来，下一轮重试
+							}
+						}
+					} else {
+						atomic.AddInt64(&sum.Removed, 1)
+					}
+					if err2 := addUser(j.u); err2 != nil {
+						if !handleIdempotent("upd-add", j.u, err2) {
+							recordFail("upd-add", j.u, err2)
+						}
+					} else {
+						atomic.AddInt64(&sum.Added, 1)
+						atomic.AddInt64(&sum.Updated, 1)
+						changes.updated(j.u.Email)
+						opts.Verbosity.detail(lg, "OK", "op", "upd", "proto", j.u.Proto, "uid", j.u.UID, "email", j.u.Email)
+					}
+
+				case "stale":
+					if err := removeUser(j.u); err != nil {
+						if !handleIdempotent("del-stale", j.u, err) {
+							recordFail("del-stale", j.u, err)
+							if !isNotFound(err) { // "fail" 策略下 NotFound 也计失败，但旧 email 确实已不在了
+								stale.add(j.u.UID, j.u.Email)
+							}
+						}
+					} else {
+						atomic.AddInt64(&sum.Removed, 1)
+						changes.removed(j.u.Email)
+						opts.Verbosity.detail(lg, "OK", "op", "del-stale", "proto", j.u.Proto, "uid", j.u.UID, "email", j.u.Email)
 					}
-				} else {
-					atomic.AddInt64(&sum.Removed, 1)
-				}
-				var err2 error
-				if j.u.Proto == "vless" {
-					err2 = cli.AddVLESS(j.u.Email, j.u.UUID, j.u.Level, j.u.Flow)
-				} else {
-					err2 = cli.AddVMess(j.u.Email, j.u.UUID, j.u.Level)
 				}
-				if err2 != nil {
-					if !handleIdempotent("upd-add", j.u, err2) {
-						recordFail("upd-add", j.u, err2)
+
+				auto.release()
+
+				// 进度日志
+				cur := atomic.AddInt64(&done, 1)
+				if cur == total || cur%200 == 0 {
+					snap := current()
+					if opts.Progress != nil {
+						opts.Progress(cur, total, snap)
+					} else {
+						perc := float64(cur) * 100 / float64(total)
+						opts.Verbosity.info(lg, "progress", "tags", tags, "processed", cur, "total", total,
+							"percent", fmt.Sprintf("%.1f", perc),
+							"added", snap.Added, "updated", snap.Updated,
+							"removed", snap.Removed, "failed", snap.Failed)
 					}
-				} else {
-					atomic.AddInt64(&sum.Added, 1)
-					atomic.AddInt64(&sum.Updated, 1)
 				}
 			}
+		}
+
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go worker()
+		}
 
-			// 进度日志
-			cur := atomic.AddInt64(&done, 1)
-			if cur == int64(totalJobs) || cur%200 == 0 {
-				perc := float64(cur) * 100 / float64(totalJobs)
-				log.Printf("progress: %d/%d (%.1f%%) added=%d updated=%d removed=%d failed=%d",
-					cur, totalJobs, perc,
-					sum.Added, sum.Updated, sum.Removed, sum.Failed)
+		// 投递任务（按 plan 的 email 顺序投递；多 worker 时完成顺序仍可能交错）
+		for _, u := range adds {
+			jobCh <- job{typ: "add", u: u}
+		}
+		for _, u := range upds {
+			jobCh <- job{typ: "upd", u: u, old: have[u.UID]}
+		}
+		for _, u := range dels {
+			jobCh <- job{typ: "del", u: u}
+		}
+		for _, u := range staleDels {
+			jobCh <- job{typ: "stale", u: u}
+		}
+
+		close(jobCh)
+		wg.Wait()
+		if auto != nil {
+			limit, peak, backoffs := auto.stats()
+			lg.Info("concurrency auto", "tags", tags, "final", limit, "peak", peak, "max", workers, "backoffs", backoffs)
+		}
+	}
+
+	var ewg sync.WaitGroup
+	for i, cli := range clis {
+		if cli == nil {
+			epSums[i].Failed = int64(totalJobs)
+			epSums[i].Error = dialErrs[i].Error()
+			continue
+		}
+		lg, ep := slog.Default(), ""
+		if len(endpoints) > 1 {
+			lg, ep = lg.With("xray", endpoints[i]), endpoints[i]
+		}
+		ewg.Add(1)
+		go func(cli *xray.Client, sum *Summary, lg *slog.Logger, ep string) {
+			defer ewg.Done()
+			runOn(cli, sum, lg, ep)
+		}(cli, epSums[i], lg, ep)
+	}
+	ewg.Wait()
+	sum.Changes = changes.result()
+	sum.Failures, sum.FailuresDropped = failures.result()
+
+	for i, es := range epSums {
+		es.Skipped = es.SkipAddExist + es.SkipDelMissing
+		sum.add(*es)
+		if len(endpoints) > 1 {
+			if sum.Endpoints == nil {
+				sum.Endpoints = make(map[string]*Summary, len(endpoints))
 			}
+			sum.Endpoints[endpoints[i]] = es
 		}
 	}
 
-	if concurrency <= 0 {
-		concurrency = 1
+	if err := ctx.Err(); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("SYNC CANCELED", "tags", tags,
+			"added", sum.Added, "updated", sum.Updated, "removed", sum.Removed, "failed", sum.Failed,
+			"total", totalJobs)
+		return sum, fmt.Errorf("sync canceled: %w (manifest not saved)", err)
 	}
-	wg.Add(concurrency)
-	for i := 0; i < concurrency; i++ {
-		go worker()
+	if ctx.Err() != nil {
+		sum.TimedOut = true
+		slog.Warn("SYNC TIMEOUT", "tags", tags, "timeout", opts.Timeout,
+			"added", sum.Added, "updated", sum.Updated, "removed", sum.Removed, "failed", sum.Failed,
+			"total", totalJobs)
+		return sum, fmt.Errorf("%w after %s (manifest not saved)", ErrSyncTimeout, opts.Timeout)
 	}
 
-	// 投递任务（顺序无要求）
-	for _, u := range adds {
-		jobCh <- job{typ: "add", u: u}
+	// 6) 写回最新权威清单（连同仍未删掉的旧 email）
+	out := stamp(have, users, time.Now().UTC())
+	stale.apply(out)
+	save(out)
+
+	if len(endpoints) > 1 {
+		for _, ep := range endpoints {
+			es := sum.Endpoints[ep]
+			slog.Info("ENDPOINT SUMMARY", "xray", ep, "tags", tags,
+				"added", es.Added, "updated", es.Updated, "removed", es.Removed, "failed", es.Failed,
+				"skipped", es.SkipAddExist+es.SkipDelMissing, "error", es.Error)
+		}
 	}
-	for _, u := range upds {
-		jobCh <- job{typ: "upd", u: u}
+	attrs := []any{"tags", tags,
+		"added", sum.Added, "updated", sum.Updated, "removed", sum.Removed, "failed", sum.Failed,
+		"skipped", sum.SkipAddExist + sum.SkipDelMissing,
+		"add_exist", sum.SkipAddExist, "del_miss", sum.SkipDelMissing,
+		"total", totalJobs,
 	}
-	for _, u := range dels {
-		jobCh <- job{typ: "del", u: u}
+	if sum.Latency = lat.stats(); sum.Latency != nil {
+		attrs = append(attrs, "rpc_calls", sum.Latency.Calls,
+			"rpc_p50_ms", sum.Latency.P50Ms, "rpc_p95_ms", sum.Latency.P95Ms,
+			"rpc_p99_ms", sum.Latency.P99Ms, "rpc_max_ms", sum.Latency.MaxMs)
 	}
+	slog.Info("SYNC SUMMARY", attrs...)
 
-	close(jobCh)
-	wg.Wait()
+	return sum, nil
+}
 
-	// 6) 写回最新权威清单
-	if err := db.Save(users); err != nil {
-		log.Printf("warn: db save failed: %v", err)
+// ---------- 内部工具 ----------
+
+// load 原子地读出一份计数拷贝（worker 仍在并发累加时使用）
+func (s *Summary) load() Summary {
+	return Summary{
+		Added:          atomic.LoadInt64(&s.Added),
+		Updated:        atomic.LoadInt64(&s.Updated),
+		Removed:        atomic.LoadInt64(&s.Removed),
+		Failed:         atomic.LoadInt64(&s.Failed),
+		SkipAddExist:   atomic.LoadInt64(&s.SkipAddExist),
+		SkipDelMissing: atomic.LoadInt64(&s.SkipDelMissing),
 	}
+}
 
-	total := int64(totalJobs)
-	log.Printf("SYNC SUMMARY: added=%d updated=%d removed=%d failed=%d skipped=%d (add-exist=%d, del-miss=%d) total=%d",
-		sum.Added, sum.Updated, sum.Removed, sum.Failed,
-		sum.SkipAddExist+sum.SkipDelMissing,
-		sum.SkipAddExist, sum.SkipDelMissing,
-		total,
-	)
+// add 把 o 的计数累加到 s（非并发场景使用）
+func (s *Summary) add(o Summary) {
+	s.Added += o.Added
+	s.Updated += o.Updated
+	s.Removed += o.Removed
+	s.Failed += o.Failed
+	s.SkipAddExist += o.SkipAddExist
+	s.SkipDelMissing += o.SkipDelMissing
+}
 
-	return sum, nil
+// dialXray 优先从 pool 取共享连接（此时 Close 不断开连接），pool 为 nil 时按 dopts 新拨号
+func dialXray(pool *xray.Pool, dopts xray.DialOptions, addr string, tags []string, timeout time.Duration) (*xray.Client, error) {
+	if pool != nil {
+		return pool.Client(addr, tags)
+	}
+	return xray.NewClient(addr, tags, timeout, dopts)
 }
 
-// ---------- 内部工具 ----------
+// splitEndpoints 把逗号分隔的地址拆开（去空白、去空项）
+func splitEndpoints(addr string) []string {
+	var out []string
+	for _, a := range strings.Split(addr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, a)
+		}
+	}
+	if len(out) == 0 {
+		out = []string{addr}
+	}
+	return out
+}
+
+// Plan 是本地清单与目标集合的差异（均按 email 排序）
+type Plan struct {
+	Adds    []store.User `json:"adds"`
+	Updates []store.User `json:"updates"` // 目标里的新记录
+	Removes []store.User `json:"removes"` // 仅 replace 模式
+}
+
+// Diff 计算 Sync 会执行的计划（不连 Xray、不写盘）：have 是本地清单，want 是目标集合
+func Diff(have, want map[string]store.User, mode string) Plan {
+	adds, upds, dels := plan(have, want, mode, false)
+	return Plan{Adds: adds, Updates: upds, Removes: dels}
+}
 
-// 计算差异集
+// 计算差异集（reseed 时只做全量 Add，已存在由上层幂等策略处理）
 func plan(have, want map[string]store.User, mode string, reseed bool) (adds, upds, dels []store.User) {
-	if reseed {
-		// 只做“全量 Add”（已存在由上层幂等策略处理）
-		adds = make([]store.User, 0, len(want))
-		for _, u := range want {
-			adds = append(adds, u)
+	if !reseed {
+		return store.Diff(have, want, mode)
+	}
+	adds = make([]store.User, 0, len(want))
+	for _, u := range want {
+		adds = append(adds, u)
+	}
+	store.SortByEmail(adds)
+	return
+}
+
+// stamp 返回带审计时间的待保存清单：新用户 CreatedAt=UpdatedAt=now；
+// 有变化的沿用旧 CreatedAt、UpdatedAt=now；无变化的原样沿用旧时间
+func stamp(have, want map[string]store.User, now time.Time) map[string]store.User {
+	out := make(map[string]store.User, len(want))
+	for uid, u := range want {
+		hu, ok := have[uid]
+		switch {
+		case !ok:
+			u.CreatedAt, u.UpdatedAt = now, now
+		case store.Equal(hu, u):
+			u.CreatedAt, u.UpdatedAt = hu.CreatedAt, hu.UpdatedAt
+		default:
+			u.CreatedAt, u.UpdatedAt = hu.CreatedAt, now
 		}
-		return
+		out[uid] = u
 	}
+	return out
+}
 
-	// want 中有而 have 没有 → add
-	// 都有但字段变了 → upd
-	for uid, wu := range want {
-		if hu, ok := have[uid]; !ok {
-			adds = append(adds, wu)
-		} else if !userEqual(hu, wu) {
-			upds = append(upds, wu)
+// mergeDels 把 extra 并入 dels（按 UID 去重）
+func mergeDels(dels, extra []store.User) []store.User {
+	if len(extra) == 0 {
+		return dels
+	}
+	seen := make(map[string]bool, len(dels))
+	for _, u := range dels {
+		seen[u.UID] = true
+	}
+	for _, u := range extra {
+		if !seen[u.UID] {
+			dels = append(dels, u)
 		}
 	}
+	store.SortByEmail(dels)
+	return dels
+}
+
+// Changed 判断本地记录 a 与目标 b 是否需要 upd（Diff 据此决定 Updates）
+func Changed(a, b store.User) bool { return !store.Equal(a, b) }
 
-	// replace 才删除：have 中有而 want 没有 → del
-	if strings.EqualFold(mode, "replace") {
-		for uid, hu := range have {
-			if _, ok := want[uid]; !ok {
-				dels = append(dels, hu)
+// withRetry 按策略执行 fn；只有 isRetryable 的错误才会重试，其余立即返回。
+// 重试轮次里遇到幂等错误，说明上一轮其实已经生效（如超时但已写入），视为成功。
+// ctx 取消后不再等待下一次重试，直接返回最后一次的错误。
+func withRetry(ctx context.Context, p RetryPolicy, idem func(error) bool, fn func() error) error {
+	attempts := p.Attempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			d := p.BaseDelay * time.Duration(i)
+			if p.Max > 0 && d > p.Max {
+				d = p.Max
+			}
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return err
 			}
 		}
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if idem(err) {
+			if i > 0 {
+				return nil
+			}
+			return err
+		}
+		if !isRetryable(err) {
+			return err
+		}
 	}
-	return
+	return err
 }
 
-// 判断两个用户是否等价（用于是否需要 upd）
-func userEqual(a, b store.User) bool {
-	if a.Proto != b.Proto {
+// isRetryable 只把瞬时错误视为可重试：Unavailable / DeadlineExceeded / ResourceExhausted。
+// InvalidArgument（如 UUID 非法）、NotFound、AlreadyExists 以及非 gRPC 错误都直接失败。
+// 多 tag 错误：任一失败 tag 可重试即重试（已成功的 tag 重试时会落到幂等分支）。
+func isRetryable(err error) bool {
+	var te xray.TagErrors
+	if errors.As(err, &te) {
+		for _, e := range te {
+			if isRetryable(e.Err) {
+				return true
+			}
+		}
 		return false
 	}
-	if a.UUID != b.UUID || a.Level != b.Level {
+	st, ok := status.FromError(err)
+	if !ok {
 		return false
 	}
-	// VLESS 的 flow 也要比对（VMess 忽略）
-	if a.Proto == "vless" && strings.TrimSpace(a.Flow) != strings.TrimSpace(b.Flow) {
-		return false
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
 	}
-	// Email/UID 做键，通常相同；不作为差异触发字段
-	return true
+	return false
 }
 
-// 幂等识别（不同 Xray 版本可能把 not found/exist 塞在 Unknown 里）
+// addVLESS 按 tag 的 flow 分组下发（没有 TagFlows 时与 AddVLESSToTags 相同），各组的失败 tag 合并返回。
+// AtomicAdd 时全成或全不成跨组成立：某组真正失败（不全是“已存在”）就不再下发后续组，并撤回此前各组加成功的 tag。
+func addVLESS(cli *xray.Client, tags []string, u store.User) error {
+	if len(u.TagFlows) == 0 {
+		return cli.AddVLESSToTags(tags, u.Email, u.UUID, u.Level, u.Flow, u.Encryption)
+	}
+	var flows []string
+	groups := make(map[string][]string)
+	for _, t := range tags {
+		f := u.FlowFor(t)
+		if _, ok := groups[f]; !ok {
+			flows = append(flows, f)
+		}
+		groups[f] = append(groups[f], t)
+	}
+	var failed xray.TagErrors
+	var added []string // 本次已加成功的 tag（AtomicAdd 撤回用）
+	for _, f := range flows {
+		err := cli.AddVLESSToTags(groups[f], u.Email, u.UUID, u.Level, f, u.Encryption)
+		if err == nil {
+			added = append(added, groups[f]...)
+			continue
+		}
+		var te xray.TagErrors
+		if !errors.As(err, &te) {
+			if cli.AtomicAdd {
+				return undoAdd(cli, u.Email, added, err)
+			}
+			return err
+		}
+		failed = append(failed, te...)
+		if cli.AtomicAdd && !isAlreadyExists(te) {
+			return undoAdd(cli, u.Email, added, failed) // 本组已加成功的 tag 由客户端撤回
+		}
+		bad := make(map[string]bool, len(te))
+		for _, e := range te {
+			bad[e.Tag] = true
+		}
+		for _, t := range groups[f] {
+			if !bad[t] {
+				added = append(added, t)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// undoAdd 把 email 从 added 上撤回；撤回失败的 tag 以 "rollback: ..." 追加到 err（为 TagErrors 时）
+func undoAdd(cli *xray.Client, email string, added []string, err error) error {
+	if len(added) == 0 {
+		return err
+	}
+	var te, rte xray.TagErrors
+	if rerr := cli.RemoveFromTags(email, added); errors.As(rerr, &rte) && errors.As(err, &te) {
+		for _, e := range rte {
+			te = append(te, xray.TagError{Tag: e.Tag, Err: fmt.Errorf("rollback: %w", e.Err)})
+		}
+		return te
+	}
+	return err
+}
+
+// failedTags 返回 err 中失败的 tag 数；不是 xray.TagErrors 时视为全部 tag 失败
+func failedTags(err error, total int) int {
+	var te xray.TagErrors
+	if errors.As(err, &te) {
+		return len(te)
+	}
+	return total
+}
+
+// allTags 判断 TagErrors 中每个 tag 的错误是否都满足 pred
+func allTags(err error, pred func(error) bool) (matched, ok bool) {
+	var te xray.TagErrors
+	if !errors.As(err, &te) {
+		return false, false
+	}
+	for _, e := range te {
+		if !pred(e.Err) {
+			return false, true
+		}
+	}
+	return len(te) > 0, true
+}
+
+// 幂等识别（不同 Xray 版本可能把 not found/exist 塞在 Unknown 里）。
+// not found 与客户端的 IgnoreNotFound 用同一判断：找不到 inbound handler（tag 不存在）不算，照常计失败。
 func isNotFound(err error) bool {
 	if err == nil {
 		return false
 	}
-	if st, ok := status.FromError(err); ok {
-		if st.Code() == codes.NotFound {
-			return true
-		}
-		msg := strings.ToLower(st.Message())
-		if strings.Contains(msg, "not found") {
-			return true
-		}
+	// 多 tag 错误：必须每个失败 tag 都是 not found，才算幂等
+	if matched, ok := allTags(err, isNotFound); ok {
+		return matched
 	}
-	return strings.Contains(strings.ToLower(err.Error()), "not found")
+	return xray.UserNotFound(err)
 }
 
 func isAlreadyExists(err error) bool {
 	if err == nil {
 		return false
 	}
+	if matched, ok := allTags(err, isAlreadyExists); ok {
+		return matched
+	}
 	if st, ok := status.FromError(err); ok {
 		if st.Code() == codes.AlreadyExists {
 			return true
@@ -0,0 +1,169 @@
+package syncer
+
+import (
+	"testing"
+
+	"github.com/zionnode/xray-admin/internal/store"
+)
+
+// emails 取出计划里各用户的 email（保持顺序）
+func emails(us []store.User) []string {
+	var out []string
+	for _, u := range us {
+		out = append(out, u.Email)
+	}
+	return out
+}
+
+func users(us ...store.User) map[string]store.User {
+	m := make(map[string]store.User, len(us))
+	for _, u := range us {
+		m[u.UID] = u
+	}
+	return m
+}
+
+func TestDiff(t *testing.T) {
+	a := vlessUser("a", "a@x", id1)
+	b := vlessUser("b", "b@x", id2)
+	aVision := a
+	aVision.Flow = "xtls-rprx-vision"
+	aVMess := a
+	aVMess.Proto = "vmess"
+
+	for _, tc := range []struct {
+		name                string
+		have, want          map[string]store.User
+		mode                string
+		adds, upds, removes []string
+	}{
+		{"identical replace is no-op", users(a, b), users(a, b), "replace", nil, nil, nil},
+		{"identical upsert is no-op", users(a, b), users(a, b), "upsert", nil, nil, nil},
+		{"replace adds and removes", users(a), users(b), "replace", []string{"b@x"}, nil, []string{"a@x"}},
+		{"upsert never removes", users(a), users(b), "upsert", []string{"b@x"}, nil, nil},
+		{"mode is case-insensitive", users(a), users(b), "REPLACE", []string{"b@x"}, nil, []string{"a@x"}},
+		{"flow-only change updates", users(a), users(aVision), "replace", nil, []string{"a@x"}, nil},
+		{"proto change updates", users(a), users(aVMess), "replace", nil, []string{"a@x"}, nil},
+		{"empty target replace removes everyone", users(a, b), users(), "replace", nil, nil, []string{"a@x", "b@x"}},
+		{"empty target upsert removes nobody", users(a, b), users(), "upsert", nil, nil, nil},
+		{"empty have adds everyone", users(), users(a, b), "replace", []string{"a@x", "b@x"}, nil, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := Diff(tc.have, tc.want, tc.mode)
+			if got := emails(p.Adds); !equalStrings(got, tc.adds) {
+				t.Errorf("adds = %v, want %v", got, tc.adds)
+			}
+			if got := emails(p.Updates); !equalStrings(got, tc.upds) {
+				t.Errorf("updates = %v, want %v", got, tc.upds)
+			}
+			if got := emails(p.Removes); !equalStrings(got, tc.removes) {
+				t.Errorf("removes = %v, want %v", got, tc.removes)
+			}
+		})
+	}
+}
+
+func TestDiffUpdateCarriesTarget(t *testing.T) {
+	a := vlessUser("a", "a@x", id1)
+	renamed := a
+	renamed.Email = "a2@x"
+	p := Diff(users(a), users(renamed), "replace")
+	if len(p.Updates) != 1 || p.Updates[0].Email != "a2@x" {
+		t.Fatalf("updates = %+v, want the renamed target record", p.Updates)
+	}
+	if len(p.Adds) != 0 || len(p.Removes) != 0 {
+		t.Errorf("rename must be an update, got adds=%v removes=%v", emails(p.Adds), emails(p.Removes))
+	}
+}
+
+func TestChanged(t *testing.T) {
+	base := vlessUser("a", "a@x", id1)
+	mod := func(f func(*store.User)) store.User {
+		u := base
+		f(&u)
+		return u
+	}
+	for _, tc := range []struct {
+		name string
+		b    store.User
+		want bool
+	}{
+		{"identical", base, false},
+		{"uuid", mod(func(u *store.User) { u.UUID = id2 }), true},
+		{"level", mod(func(u *store.User) { u.Level = 3 }), true},
+		{"flow", mod(func(u *store.User) { u.Flow = "xtls-rprx-vision" }), true},
+		{"flow whitespace only", mod(func(u *store.User) { u.Flow = " " }), false},
+		{"proto", mod(func(u *store.User) { u.Proto = "vmess" }), true},
+		{"email", mod(func(u *store.User) { u.Email = "b@x" }), true},
+		{"tags", mod(func(u *store.User) { u.Tags = []string{"t"} }), true},
+		{"note ignored", mod(func(u *store.User) { u.Note = "pro" }), false},
+		{"quota ignored", mod(func(u *store.User) { u.Quota = 1 << 30 }), false},
+	} {
+		if got := Changed(base, tc.b); got != tc.want {
+			t.Errorf("%s: Changed = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// VMess 不看 flow，但看 alterId/security
+	vm := base
+	vm.Proto = "vmess"
+	vmFlow, vmAlter := vm, vm
+	vmFlow.Flow = "xtls-rprx-vision"
+	vmAlter.AlterID = 4
+	if Changed(vm, vmFlow) {
+		t.Error("vmess flow change should be ignored")
+	}
+	if !Changed(vm, vmAlter) {
+		t.Error("vmess alterId change should update")
+	}
+}
+
+// plan 的三个结果按 email 排序（同 email 按 UID），与 map 的遍历顺序无关
+func TestPlanSortedByEmail(t *testing.T) {
+	mk := func(uid, email string, level uint32) store.User {
+		u := vlessUser(uid, email, id1)
+		u.Level = level
+		return u
+	}
+	have, want := map[string]store.User{}, map[string]store.User{}
+	for _, e := range []string{"m", "c", "x", "a", "q"} {
+		have["upd-"+e] = mk("upd-"+e, "upd-"+e+"@x", 0)
+		want["upd-"+e] = mk("upd-"+e, "upd-"+e+"@x", 1)
+		want["add-"+e] = mk("add-"+e, "add-"+e+"@x", 0)
+		have["del-"+e] = mk("del-"+e, "del-"+e+"@x", 0)
+	}
+	// 同一 email 的两条记录按 UID 排
+	want["dup-2"] = mk("dup-2", "dup@x", 0)
+	want["dup-1"] = mk("dup-1", "dup@x", 0)
+
+	sorted := func(us []store.User) bool {
+		for i := 1; i < len(us); i++ {
+			a, b := us[i-1], us[i]
+			if a.Email > b.Email || (a.Email == b.Email && a.UID > b.UID) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 20; i++ { // map 遍历顺序每次不同：多跑几次
+		adds, upds, dels := plan(have, want, "replace", false)
+		if len(adds) != 7 || len(upds) != 5 || len(dels) != 5 {
+			t.Fatalf("plan sizes = %d/%d/%d, want 7/5/5", len(adds), len(upds), len(dels))
+		}
+		for name, us := range map[string][]store.User{"adds": adds, "upds": upds, "dels": dels} {
+			if !sorted(us) {
+				t.Fatalf("%s not sorted: %v", name, emails(us))
+			}
+		}
+		var uids []string
+		for _, u := range adds {
+			uids = append(uids, u.UID)
+		}
+		if want := []string{"add-a", "add-c", "add-m", "add-q", "add-x", "dup-1", "dup-2"}; !equalStrings(uids, want) {
+			t.Fatalf("adds = %v, want %v", uids, want)
+		}
+		if reseed, _, _ := plan(have, want, "replace", true); !sorted(reseed) {
+			t.Fatalf("reseed adds not sorted: %v", emails(reseed))
+		}
+	}
+}
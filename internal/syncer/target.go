@@ -0,0 +1,93 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+	"github.com/zionnode/xray-admin/internal/store"
+)
+
+// Target 按 cfg 把远端响应 res 变成 proto 的目标集合，与 Run 走同一条流水线：
+// client 变换（NormalizeEmail → PlanLevels → DeriveUUID → Identity）→ 远端保护检查
+// （StrictRemote、空响应、StrictDup）→ 生效 tag（OnlyTags/ExcludeTags）→ BuildUsers → FlowMap。
+// 保护检查拦下时返回与 Run 相同的错误；该协议没有生效 tag 时返回 ErrNoRemoteTags（Run 此时不碰该协议）。
+// 不连 Xray，所以不剔除 Xray 上不存在的 tag；增量结果也不与本地清单合并。res 不会被修改。
+func Target(cfg Config, res *remote.FetchResult, proto string) (map[string]store.User, error) {
+	r := *res
+	r.Clients = prepareClients(cfg, r.Clients)
+	if err := checkRemote(cfg, &r); err != nil {
+		return nil, err
+	}
+	tags := EffectiveTags(cfg, &r, proto)
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoRemoteTags, proto)
+	}
+	return buildTarget(cfg, r.Clients, proto, tags), nil
+}
+
+// prepareClients 依次应用 cfg 里的 client 变换（均返回副本）
+func prepareClients(cfg Config, clients []remote.ClientLite) []remote.ClientLite {
+	if cfg.NormalizeEmail {
+		clients = NormalizeEmails(clients)
+	}
+	clients = ApplyPlanLevels(clients, cfg.PlanLevels)
+	if cfg.DeriveUUID {
+		var n int
+		if clients, n = deriveIDs(clients); n > 0 {
+			cfg.Options.Verbosity.infof("derived %d uuid(s) from email (public_id=%s)", n, cfg.PublicID)
+		}
+	}
+	return ApplyIdentity(clients, cfg.Identity)
+}
+
+// checkRemote 是同步前对远端响应的保护检查，返回非 nil 表示应放弃本轮
+func checkRemote(cfg Config, res *remote.FetchResult) error {
+	// 结构检查：上游改了格式时解析结果往往是空的，replace 模式下会删光所有人
+	if err := remote.Validate(res); err != nil && !res.Incremental {
+		if cfg.StrictRemote {
+			log.Printf("abort: %v (public_id=%s, -strict-remote); skip this cycle", err, cfg.PublicID)
+			return err
+		}
+		log.Printf("warn: %v (public_id=%s)", err, cfg.PublicID)
+	}
+
+	// 有 tag 却 0 个 client：几乎总是上游 bug，replace 模式下会删光所有人
+	if !res.Incremental && len(res.Clients) == 0 && (len(res.TagsVLESS) > 0 || len(res.TagsVMESS) > 0) && !cfg.AllowEmpty {
+		log.Printf("warn: remote returned 0 clients but tags vless=%v vmess=%v (public_id=%s); skip this cycle (use -allow-empty to sync anyway)",
+			res.TagsVLESS, res.TagsVMESS, cfg.PublicID)
+		return errors.New("remote returned 0 clients with non-empty tags")
+	}
+
+	// 同一 email 对应多个不同 id：map 只会保留最后一条，Xray 里可能残留旧 UUID
+	if dups := duplicateEmails(res.Clients); len(dups) > 0 {
+		for email, ids := range dups {
+			log.Printf("warn: duplicate email in remote clients: email=%s ids=%v", email, ids)
+		}
+		if cfg.StrictDup {
+			log.Printf("abort: %d duplicate emails in remote response (-strict-dup); skip this cycle", len(dups))
+			return fmt.Errorf("%d duplicate emails in remote response", len(dups))
+		}
+	}
+	return nil
+}
+
+// EffectiveTags 返回 proto 在本进程管理范围内的远端 tag（按 OnlyTags/ExcludeTags 过滤）
+func EffectiveTags(cfg Config, res *remote.FetchResult, proto string) []string {
+	tags := res.TagsVLESS
+	if proto == "vmess" {
+		tags = res.TagsVMESS
+	}
+	if len(cfg.OnlyTags) > 0 || len(cfg.ExcludeTags) > 0 {
+		tags = filterTags(tags, cfg.OnlyTags, cfg.ExcludeTags)
+	}
+	return tags
+}
+
+// buildTarget 由（已变换的）clients 构建 proto 在 tags 上的目标集合
+func buildTarget(cfg Config, clients []remote.ClientLite, proto string, tags []string) map[string]store.User {
+	users := BuildUsers(clients, proto, tags, cfg.DefaultLevel, cfg.DefaultFlow)
+	ApplyFlowMap(users, tags, cfg.FlowMap)
+	return users
+}
@@ -0,0 +1,90 @@
+package syncer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+	"github.com/zionnode/xray-admin/internal/store"
+	"github.com/zionnode/xray-admin/internal/xray/xraytest"
+)
+
+func TestTargetGuards(t *testing.T) {
+	empty := &remote.FetchResult{TagsVLESS: []string{"v"}, Clients: []remote.ClientLite{}}
+
+	// 有 tag 却 0 个 client：与 Run 一样拒绝，而不是预览“删光所有人”
+	if _, err := Target(Config{}, empty, "vless"); err == nil {
+		t.Error("empty response with tags: want error")
+	}
+	if users, err := Target(Config{AllowEmpty: true}, empty, "vless"); err != nil || len(users) != 0 {
+		t.Errorf("AllowEmpty: users=%v err=%v, want empty target", users, err)
+	}
+
+	// 该协议没有 tag：Run 不碰它，Target 报 ErrNoRemoteTags
+	one := &remote.FetchResult{TagsVLESS: []string{"v"}, Clients: []remote.ClientLite{{ID: id1, Email: "a@x"}}}
+	if _, err := Target(Config{}, one, "vmess"); !errors.Is(err, ErrNoRemoteTags) {
+		t.Errorf("vmess without tags: err=%v, want ErrNoRemoteTags", err)
+	}
+	if _, err := Target(Config{ExcludeTags: []string{"v"}}, one, "vless"); !errors.Is(err, ErrNoRemoteTags) {
+		t.Errorf("all tags excluded: err=%v, want ErrNoRemoteTags", err)
+	}
+
+	dup := &remote.FetchResult{TagsVLESS: []string{"v"}, Clients: []remote.ClientLite{{ID: id1, Email: "a@x"}, {ID: id2, Email: "a@x"}}}
+	if _, err := Target(Config{StrictDup: true}, dup, "vless"); err == nil {
+		t.Error("StrictDup with duplicate emails: want error")
+	}
+}
+
+// Target 的结果就是 Run 写进清单的目标集合（同一条流水线）
+func TestTargetMatchesRun(t *testing.T) {
+	_, opts := fakeXray(t, "v1", "v2")
+	res := &remote.FetchResult{
+		TagsVLESS: []string{"v1", "v2", "other"},
+		Clients: []remote.ClientLite{
+			{ID: id1, Email: "  Alice@X ", Plan: "pro"},
+			{Email: "bob@x"}, // 缺 id：DeriveUUID 补上
+		},
+	}
+	cfg := Config{
+		XrayAddr:       xraytest.Addr,
+		Mode:           "replace",
+		Concurrency:    2,
+		DefaultLevel:   1,
+		PlanLevels:     map[string]uint32{"pro": 3},
+		FlowMap:        map[string]string{"v2": "xtls-rprx-vision"},
+		NormalizeEmail: true,
+		DeriveUUID:     true,
+		OnlyTags:       []string{"v1", "v2"},
+		DBV:            store.NewMemory(),
+		Options:        opts,
+	}
+
+	want, err := Target(cfg, res, "vless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Clients[0].Email != "  Alice@X " {
+		t.Fatal("Target modified its input")
+	}
+	if _, ok := want["alice@x"]; !ok || want["alice@x"].Level != 3 || len(want) != 2 {
+		t.Fatalf("target = %+v, want normalized alice (level 3) and derived bob", want)
+	}
+
+	pushed := *res
+	cfg.Pushed = &pushed
+	if _, err := Run(cfg); err != nil {
+		t.Fatal(err)
+	}
+	have, err := cfg.DBV.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(want) {
+		t.Fatalf("run saved %d users, target has %d", len(have), len(want))
+	}
+	for uid, w := range want {
+		if h, ok := have[uid]; !ok || !store.Equal(h, w) {
+			t.Errorf("uid %s: run saved %+v, target %+v", uid, h, w)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package syncer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/zionnode/xray-admin/internal/remote"
+)
+
+// uuidNamespace 是 RFC 4122 的 URL 命名空间（6ba7b811-9dad-11d1-80b4-00c04fd430c8）：
+// 与 Python uuid.uuid5(uuid.NAMESPACE_URL, email) 等实现结果一致，便于上游/其他节点复现
+var uuidNamespace = [16]byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+// DeriveUUID 由 email 派生确定的 UUIDv5（同一 email 在任何节点上都得到同一个 UUID）
+func DeriveUUID(email string) string {
+	h := sha1.New()
+	h.Write(uuidNamespace[:])
+	h.Write([]byte(email))
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = u[6]&0x0f | 0x50 // version 5
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	x := hex.EncodeToString(u[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", x[0:8], x[8:12], x[12:16], x[16:20], x[20:])
+}
+
+// deriveIDs 为缺 id 的 client 补上 DeriveUUID(email)，返回副本与补了多少个
+func deriveIDs(clients []remote.ClientLite) ([]remote.ClientLite, int) {
+	out := make([]remote.ClientLite, len(clients))
+	n := 0
+	for i, c := range clients {
+		if c.ID == "" && c.Email != "" {
+			c.ID = DeriveUUID(c.Email)
+			n++
+		}
+		out[i] = c
+	}
+	return out, n
+}
+
+// DeriveUUIDs 与 Config.DeriveUUID 相同：返回为缺 id 的 client 补上派生 UUID 的副本
+func DeriveUUIDs(clients []remote.ClientLite) []remote.ClientLite {
+	out, _ := deriveIDs(clients)
+	return out
+}
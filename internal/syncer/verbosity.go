@@ -0,0 +1,51 @@
+package syncer
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Verbosity 控制同步过程的日志量（零值即 normal）；告警、失败与最终汇总在任何级别都会输出
+type Verbosity int
+
+const (
+	VerbosityNormal  Verbosity = iota // 进度、计划、幂等跳过等过程日志
+	VerbosityQuiet                    // 只输出最终汇总、告警与失败
+	VerbosityVerbose                  // 额外输出每个成功的用户操作
+)
+
+// ParseVerbosity 解析 quiet | normal | verbose（空串为 normal）
+func ParseVerbosity(s string) (Verbosity, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "normal":
+		return VerbosityNormal, nil
+	case "quiet":
+		return VerbosityQuiet, nil
+	case "verbose":
+		return VerbosityVerbose, nil
+	}
+	return VerbosityNormal, fmt.Errorf("unknown verbosity %q (quiet|normal|verbose)", s)
+}
+
+// infof 输出过程日志（quiet 时不输出）
+func (v Verbosity) infof(format string, args ...any) {
+	if v != VerbosityQuiet {
+		log.Printf(format, args...)
+	}
+}
+
+// info 是 infof 的 slog 版本
+func (v Verbosity) info(lg *slog.Logger, msg string, args ...any) {
+	if v != VerbosityQuiet {
+		lg.Info(msg, args...)
+	}
+}
+
+// detail 仅在 verbose 时输出（逐个用户的成功操作）
+func (v Verbosity) detail(lg *slog.Logger, msg string, args ...any) {
+	if v == VerbosityVerbose {
+		lg.Info(msg, args...)
+	}
+}
@@ -2,54 +2,157 @@ package xray
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/xtls/xray-core/app/proxyman/command"
+	statscmd "github.com/xtls/xray-core/app/stats/command"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
+	xuuid "github.com/xtls/xray-core/common/uuid"
 	"github.com/xtls/xray-core/proxy/vless"
 	"github.com/xtls/xray-core/proxy/vmess"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
 )
 
+// DefaultTagConcurrency 是单个用户在多个 tag 上并发下发的默认上限
+const DefaultTagConcurrency = 8
+
+// DialOptions 是拨号时附加的 gRPC 连接参数（零值即 gRPC 默认）
+type DialOptions struct {
+	// MaxRecvMsgSize 是单条 gRPC 响应上限（字节，<=0 用 gRPC 默认 4MB）。
+	// 用户很多时 QueryStats 的流量统计响应可能超过默认值而返回 ResourceExhausted。
+	MaxRecvMsgSize int
+
+	// Keepalive 是 gRPC keepalive 参数（Time<=0 不启用）。空闲期间定期 ping，
+	// 让被 NAT/防火墙静默丢弃的连接尽早断开重连，而不是等到下一轮调用时才超时。
+	// 注意 Xray 的 API 服务端沿用 gRPC 默认策略：ping 间隔低于 5m（无活动流时低于 2h）会被视为过频，
+	// 连续几次后服务端断开连接，客户端随后把间隔翻倍。
+	Keepalive keepalive.ClientParameters
+}
+
 type Client struct {
 	API     command.HandlerServiceClient
 	Conn    *grpc.ClientConn
 	Tags    []string
 	Timeout time.Duration
+
+	// TagConcurrency 限制一次操作同时打到多少个 tag（<=0 视为 1，即串行）
+	TagConcurrency int
+
+	// IgnoreNotFound 为 true 时，Remove 把“用户不存在”视为该 tag 成功，只返回真正的失败
+	IgnoreNotFound bool
+
+	// Context 是所有 RPC 的父 context（nil 即 Background）；取消后进行中与后续的调用立即失败
+	Context context.Context
+
+	// Throttle 非 nil 时在每次 AlterInbound 前调用（由调用方实现限速，如 rate.Limiter.Wait），ctx 即 Context。
+	// 排队等待不占用单次调用的 Timeout；返回错误（如 ctx 已取消）时不发这次调用，错误记为该 tag 的失败。
+	Throttle func(ctx context.Context) error
+
+	// AtomicAdd 为 true 时，Add 在任一 tag 真正失败后，把用户从本次已加成功的 tag 上撤回（全成或全不成）
+	AtomicAdd bool
+
+	shared bool // Conn 归 Pool 所有，Close 不关闭连接
+}
+
+// TagError 是某个 tag 上的失败
+type TagError struct {
+	Tag string
+	Err error
+}
+
+// TagErrors 汇总一次多 tag 操作中失败的 tag（成功的 tag 不在其中）
+type TagErrors []TagError
+
+func (e TagErrors) Error() string {
+	parts := make([]string, 0, len(e))
+	for _, te := range e {
+		st, _ := status.FromError(te.Err)
+		parts = append(parts, fmt.Sprintf("tag=%s code=%s err=%v", te.Tag, st.Code(), te.Err))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func NewClient(addr string, tags []string, timeout time.Duration, opts DialOptions) (*Client, error) {
+	conn, err := dial(addr, timeout, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, tags, timeout), nil
 }
 
-func NewClient(addr string, tags []string, timeout time.Duration) (*Client, error) {
-    // 用同一个超时做拨号超时
-    ctx, cancel := context.WithTimeout(context.Background(), timeout)
-    defer cancel()
-
-    conn, err := grpc.DialContext(
-        ctx,
-        addr,
-        grpc.WithTransportCredentials(insecure.NewCredentials()),
-        grpc.WithBlock(),
-        grpc.WithReturnConnectionError(), // ← 不要参数
-    )
-    if err != nil {
-        return nil, err
-    }
-    api := command.NewHandlerServiceClient(conn)
-    return &Client{
-        API:     api,
-        Conn:    conn,
-        Tags:    append([]string(nil), tags...),
-        Timeout: timeout,
-    }, nil
+func newClient(conn *grpc.ClientConn, tags []string, timeout time.Duration) *Client {
+	return &Client{
+		API:     command.NewHandlerServiceClient(conn),
+		Conn:    conn,
+		Tags:    append([]string(nil), tags...),
+		Timeout: timeout,
+
+		TagConcurrency: DefaultTagConcurrency,
+	}
+}
+
+// dial 阻塞拨号直到连接就绪或超时（用同一个超时做拨号超时）；dialer 非 nil 时由它建立底层连接
+func dial(addr string, timeout time.Duration, dialer func(context.Context, string) (net.Conn, error), opts DialOptions) (*grpc.ClientConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	target, dialOpts := dialTarget(addr)
+	if dialer != nil {
+		target, dialOpts = "passthrough:///"+addr, []grpc.DialOption{grpc.WithContextDialer(dialer)}
+	}
+	dialOpts = append(dialOpts,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithReturnConnectionError(), // ← 不要参数
+	)
+	if opts.MaxRecvMsgSize > 0 {
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(opts.MaxRecvMsgSize)))
+	}
+	if opts.Keepalive.Time > 0 {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(opts.Keepalive))
+	}
+	return grpc.DialContext(ctx, target, dialOpts...)
+}
+
+// dialTarget 支持 unix:///path/to/xray.sock（或 unix:path）形式的地址，其余按 TCP host:port 处理
+func dialTarget(addr string) (string, []grpc.DialOption) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		path, ok = strings.CutPrefix(addr, "unix:")
+	}
+	if !ok {
+		return addr, nil
+	}
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return "passthrough:///" + path, []grpc.DialOption{grpc.WithContextDialer(dialer)}
+}
+
+func (c *Client) parent() context.Context {
+	if c.Context != nil {
+		return c.Context
+	}
+	return context.Background()
 }
 
 func (c *Client) Close() error {
-	if c.Conn != nil {
+	if c.Conn != nil && !c.shared {
 		return c.Conn.Close()
 	}
 	return nil
@@ -57,73 +160,420 @@ func (c *Client) Close() error {
 
 // ---- High-level helpers ----
 
-func (c *Client) AddVLESS(email, uuid string, level uint32, flow string) error {
+// AddVLESS 的 encryption 为空时不设置（即 Xray 默认的 none）；后量子等新加密方式由调用方给出
+func (c *Client) AddVLESS(email, uuid string, level uint32, flow, encryption string) error {
+	u, err := NewVLESSUser(email, uuid, level, flow, encryption)
+	if err != nil {
+		return err
+	}
+	return c.addUserAll(u)
+}
+
+// AddVMess 的 alterID/security 为空值时保持 Xray 默认（alterId 0、security auto）
+func (c *Client) AddVMess(email, uuid string, level, alterID uint32, security string) error {
+	u, err := NewVMessUser(email, uuid, level, alterID, security)
+	if err != nil {
+		return err
+	}
+	return c.addUserAll(u)
+}
+
+// NewVLESSUser 构造 AddVLESS 下发的用户（供 AddBatch 使用）；id 不合法时返回 InvalidArgument
+func NewVLESSUser(email, uuid string, level uint32, flow, encryption string) (*protocol.User, error) {
+	if err := checkID(email, uuid); err != nil {
+		return nil, err
+	}
 	acc := &vless.Account{Id: uuid}
 	if strings.TrimSpace(flow) != "" {
 		acc.Flow = flow // 只有非空才设置
 	}
-	u := &protocol.User{
+	if strings.TrimSpace(encryption) != "" {
+		acc.Encryption = strings.TrimSpace(encryption)
+	}
+	return &protocol.User{
 		Email:   email,
 		Level:   level,
 		Account: serial.ToTypedMessage(acc),
-	}
-	return c.addUserAll(u)
+	}, nil
 }
 
-func (c *Client) AddVMess(email, uuid string, level uint32) error {
-	acc := &vmess.Account{Id: uuid}
-	u := &protocol.User{
+// NewVMessUser 构造 AddVMess 下发的用户（供 AddBatch 使用）；id 不合法时返回 InvalidArgument
+func NewVMessUser(email, uuid string, level, alterID uint32, security string) (*protocol.User, error) {
+	if err := checkID(email, uuid); err != nil {
+		return nil, err
+	}
+	acc := &vmess.Account{Id: uuid, AlterId: alterID}
+	if strings.TrimSpace(security) != "" {
+		st, err := vmessSecurity(security)
+		if err != nil {
+			return nil, err
+		}
+		acc.SecuritySettings = &protocol.SecurityConfig{Type: st}
+	}
+	return &protocol.User{
 		Email:   email,
 		Level:   level,
 		Account: serial.ToTypedMessage(acc),
+	}, nil
+}
+
+// AddBatch 把一批用户加到 c.Tags：每个 tag 上按顺序连续发送（tag 之间并发，受 TagConcurrency 限制），
+// 省去逐个用户等待整轮 tag 的开销。返回值与 users 一一对应：nil 或该用户失败 tag 的 TagErrors。
+// 不做 AtomicAdd 回滚，也不重试；需要这些语义时逐个调用 AddVLESS/AddVMess。
+func (c *Client) AddBatch(users []*protocol.User) []error {
+	ops := make([]*serial.TypedMessage, len(users))
+	for i, u := range users {
+		ops[i] = serial.ToTypedMessage(&command.AddUserOperation{User: u})
 	}
-	return c.addUserAll(u)
+	return c.batch(ops, nil)
+}
+
+// RemoveBatch 与 AddBatch 相同的方式把一批 email 从 c.Tags 上删除（Xray API 没有批量/流式接口，
+// 这里省的是每个用户一轮 context 与 tag 扇出）。IgnoreNotFound 时“用户不存在”视为该 tag 成功。
+func (c *Client) RemoveBatch(emails []string) []error {
+	ops := make([]*serial.TypedMessage, len(emails))
+	for i, email := range emails {
+		ops[i] = serial.ToTypedMessage(&command.RemoveUserOperation{Email: email})
+	}
+	var ignore func(error) bool
+	if c.IgnoreNotFound {
+		ignore = UserNotFound
+	}
+	return c.batch(ops, ignore)
+}
+
+// batch 在每个 tag 上顺序发送 ops（tag 之间并发），返回与 ops 一一对应的 TagErrors；ignore 命中的错误不计
+func (c *Client) batch(ops []*serial.TypedMessage, ignore func(error) bool) []error {
+	out := make([]error, len(ops))
+	if len(ops) == 0 {
+		return out
+	}
+
+	limit := c.TagConcurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	errs := make([][]error, len(c.Tags)) // [tag][op]
+
+	var wg sync.WaitGroup
+	for i, tag := range c.Tags {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, tag string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = make([]error, len(ops))
+			for j, op := range ops {
+				errs[i][j] = c.alter(tag, op)
+			}
+		}(i, tag)
+	}
+	wg.Wait()
+
+	for j := range ops {
+		var te TagErrors
+		for i, tag := range c.Tags {
+			if err := errs[i][j]; err != nil && (ignore == nil || !ignore(err)) {
+				te = append(te, TagError{Tag: tag, Err: err})
+			}
+		}
+		if len(te) > 0 {
+			out[j] = te
+		}
+	}
+	return out
 }
 
 func (c *Client) Remove(email string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
-	defer cancel()
+	err := c.alterAll(serial.ToTypedMessage(&command.RemoveUserOperation{
+		Email: email,
+	}))
+	if err == nil || !c.IgnoreNotFound {
+		return err
+	}
+	var rest TagErrors
+	for _, te := range err.(TagErrors) {
+		if !UserNotFound(te.Err) {
+			rest = append(rest, te)
+		}
+	}
+	if len(rest) > 0 {
+		return rest
+	}
+	return nil
+}
 
-	var errs []string
-	for _, tag := range c.Tags {
-		_, err := c.API.AlterInbound(ctx, &command.AlterInboundRequest{
-			Tag: tag,
-			Operation: serial.ToTypedMessage(&command.RemoveUserOperation{
-				Email: email,
-			}),
-		})
-		if err != nil {
-			st, _ := status.FromError(err)
-			errs = append(errs, fmt.Sprintf("tag=%s code=%s err=%v", tag, st.Code(), err))
+// ---- 只作用于部分 tag 的变体（tags 不必是 c.Tags 的子集）----
+
+// AddVLESSToTags 与 AddVLESS 相同，但只下发到给定的 tags
+func (c *Client) AddVLESSToTags(tags []string, email, uuid string, level uint32, flow, encryption string) error {
+	return c.scoped(tags).AddVLESS(email, uuid, level, flow, encryption)
+}
+
+// AddVMessToTags 与 AddVMess 相同，但只下发到给定的 tags
+func (c *Client) AddVMessToTags(tags []string, email, uuid string, level, alterID uint32, security string) error {
+	return c.scoped(tags).AddVMess(email, uuid, level, alterID, security)
+}
+
+// RemoveFromTags 只从给定的 tags 删除用户（如从 REALITY 降级但保留在普通 VLESS 上）
+func (c *Client) RemoveFromTags(email string, tags []string) error {
+	return c.scoped(tags).Remove(email)
+}
+
+// RemoveAll 把 emails 逐个从 tag 上删除，返回实际删掉的个数（不存在的用户跳过）。
+// 当前 Xray API 不能列出 inbound 里的用户，调用方需自行提供候选 email（如本地清单、流量统计）。
+func (c *Client) RemoveAll(tag string, emails []string) (int, error) {
+	one := c.scoped([]string{tag})
+	removed := 0
+	var failed TagErrors
+	for _, email := range emails {
+		err := one.alterAll(serial.ToTypedMessage(&command.RemoveUserOperation{Email: email}))
+		switch {
+		case err == nil:
+			removed++
+		case UserNotFound(err.(TagErrors)[0].Err):
+		default:
+			failed = append(failed, TagError{Tag: tag, Err: fmt.Errorf("%s: %w", email, err.(TagErrors)[0].Err)})
 		}
 	}
-	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+	if len(failed) > 0 {
+		return removed, failed
+	}
+	return removed, nil
+}
+
+// scoped 返回共用同一连接、只作用于 tags 的浅拷贝（Close 仍应只调用原 Client 的）
+func (c *Client) scoped(tags []string) *Client {
+	cc := *c
+	cc.Tags = append([]string(nil), tags...)
+	return &cc
+}
+
+// ErrUnknownTag 表示 Xray 上没有这个 inbound tag
+var ErrUnknownTag = errors.New("unknown inbound tag")
+
+// Probe 逐个 tag 删除一个随机的、不存在的 email，用来确认连接和 tag 都可用（不改变任何状态）。
+// 返回值按 tag 给出结果：nil 表示可用；tag 不存在时错误包装 ErrUnknownTag。
+func (c *Client) Probe() map[string]error {
+	var rnd [8]byte
+	_, _ = rand.Read(rnd[:])
+	op := serial.ToTypedMessage(&command.RemoveUserOperation{
+		Email: "xray-admin-probe-" + hex.EncodeToString(rnd[:]),
+	})
+
+	out := make(map[string]error, len(c.Tags))
+	for _, tag := range c.Tags {
+		ctx, cancel := context.WithTimeout(c.parent(), c.Timeout)
+		_, err := c.API.AlterInbound(ctx, &command.AlterInboundRequest{Tag: tag, Operation: op})
+		cancel()
+		out[tag] = probeResult(err)
+	}
+	return out
+}
+
+// ErrUnavailable 表示 Xray API 当前不可用（连接已关闭、连不上或调用超时）
+var ErrUnavailable = errors.New("xray api unavailable")
+
+// Ping 用一次最小的 RPC（在空 tag 上删除不存在的用户）确认连接仍可用，不依赖任何 inbound 与 stats。
+// 服务端只要作出了应答（哪怕是 tag 不存在）即视为可用；否则返回包装了 ErrUnavailable 的错误。
+func (c *Client) Ping(ctx context.Context) error {
+	if c.Conn != nil && c.Conn.GetState() == connectivity.Shutdown {
+		return fmt.Errorf("%w: connection closed", ErrUnavailable)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	_, err := c.API.AlterInbound(ctx, &command.AlterInboundRequest{
+		Operation: serial.ToTypedMessage(&command.RemoveUserOperation{Email: "xray-admin-ping"}),
+	})
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
 	return nil
 }
 
+// probeResult：用户 not found 说明 inbound 在且处理了请求；找不到 handler 则是 tag 不存在
+func probeResult(err error) error {
+	switch {
+	case err == nil, UserNotFound(err):
+		return nil
+	case unknownTag(err):
+		return fmt.Errorf("%w: %v", ErrUnknownTag, err)
+	}
+	return err
+}
+
+// unknownTag：Xray 找不到该 tag 对应的 inbound handler
+func unknownTag(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "failed to get handler") || strings.Contains(msg, "handler not found")
+}
+
+// alreadyExists：该 tag 上已有同 email 的用户
+func alreadyExists(err error) bool {
+	if st, ok := status.FromError(err); ok && st.Code() == codes.AlreadyExists {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "already exists")
+}
+
+// UserNotFound 判断 err 是否表示 inbound 存在、但其中没有这个用户（tag 不存在不算，见 ErrUnknownTag）。
+// 删除时据此把“用户已不在”当作幂等成功。
+func UserNotFound(err error) bool {
+	if err == nil || unknownTag(err) {
+		return false
+	}
+	if st, ok := status.FromError(err); ok && st.Code() == codes.NotFound {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "not found")
+}
+
+// UserTraffic 一次性查询所有用户的累计流量（uplink+downlink，字节），key 为 email。
+// 依赖 Xray 开启 stats 与 policy 中的 statsUserUplink/Downlink；未产生流量的用户不会出现在结果里。
+func (c *Client) UserTraffic() (map[string]int64, error) {
+	ctx, cancel := context.WithTimeout(c.parent(), c.Timeout)
+	defer cancel()
+
+	resp, err := statscmd.NewStatsServiceClient(c.Conn).QueryStats(ctx, &statscmd.QueryStatsRequest{
+		Pattern: "user>>>",
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]int64)
+	for _, st := range resp.GetStat() {
+		// 形如 user>>>{email}>>>traffic>>>uplink
+		parts := strings.Split(st.GetName(), ">>>")
+		if len(parts) != 4 || parts[0] != "user" || parts[2] != "traffic" {
+			continue
+		}
+		out[parts[1]] += st.GetValue()
+	}
+	return out, nil
+}
+
 // ---- Internal helpers ----
 
+// checkID 按 Xray 自己的规则（uuid.ParseString：标准 UUID，或 1-30 字节的字符串映射）在发请求前校验 id，
+// 把服务端含糊的报错变成带 email 的 InvalidArgument
+func checkID(email, id string) error {
+	if _, err := xuuid.ParseString(id); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid id %q for user %s: %v", id, email, err)
+	}
+	return nil
+}
+
+// vmessSecurity 把 security 名称（如 aes-128-gcm）映射为 protocol.SecurityType
+func vmessSecurity(s string) (protocol.SecurityType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "auto":
+		return protocol.SecurityType_AUTO, nil
+	case "aes-128-gcm":
+		return protocol.SecurityType_AES128_GCM, nil
+	case "chacha20-poly1305":
+		return protocol.SecurityType_CHACHA20_POLY1305, nil
+	case "none":
+		return protocol.SecurityType_NONE, nil
+	case "zero":
+		return protocol.SecurityType_ZERO, nil
+	}
+	return protocol.SecurityType_UNKNOWN, fmt.Errorf("unsupported vmess security: %q", s)
+}
+
 func (c *Client) addUserAll(u *protocol.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
-	defer cancel()
+	err := c.alterAll(serial.ToTypedMessage(&command.AddUserOperation{
+		User: u,
+	}))
+	if err == nil || !c.AtomicAdd {
+		return err
+	}
+	return c.rollbackAdd(u.Email, err.(TagErrors))
+}
 
-	var errs []string
+// rollbackAdd 在部分 tag 加失败时撤回已成功的 tag。
+// 失败 tag 全是“已存在”说明用户其实已齐全，不撤回；撤回失败会追加到返回的 TagErrors 里。
+func (c *Client) rollbackAdd(email string, errs TagErrors) error {
+	failed := make(map[string]bool, len(errs))
+	genuine := false
+	for _, te := range errs {
+		failed[te.Tag] = true
+		if !alreadyExists(te.Err) {
+			genuine = true
+		}
+	}
+	if !genuine {
+		return errs
+	}
+	var added []string
 	for _, tag := range c.Tags {
-		_, err := c.API.AlterInbound(ctx, &command.AlterInboundRequest{
-			Tag: tag,
-			Operation: serial.ToTypedMessage(&command.AddUserOperation{
-				User: u,
-			}),
-		})
+		if !failed[tag] {
+			added = append(added, tag)
+		}
+	}
+	if len(added) == 0 {
+		return errs
+	}
+	err := c.alterTags(added, serial.ToTypedMessage(&command.RemoveUserOperation{Email: email}))
+	if err != nil {
+		for _, te := range err.(TagErrors) {
+			errs = append(errs, TagError{Tag: te.Tag, Err: fmt.Errorf("rollback: %w", te.Err)})
+		}
+	}
+	return errs
+}
+
+// alterAll 对 c.Tags 并发执行同一个 AlterInbound 操作（并发度受 TagConcurrency 限制）。
+// 只要有 tag 失败就返回 TagErrors（只包含失败的 tag），调用方据此区分部分成功。
+func (c *Client) alterAll(op *serial.TypedMessage) error {
+	return c.alterTags(c.Tags, op)
+}
+
+func (c *Client) alterTags(tags []string, op *serial.TypedMessage) error {
+	limit := c.TagConcurrency
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	results := make([]error, len(tags))
+
+	var wg sync.WaitGroup
+	for i, tag := range tags {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, tag string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = c.alter(tag, op)
+		}(i, tag)
+	}
+	wg.Wait()
+
+	var errs TagErrors
+	for i, err := range results {
 		if err != nil {
-			st, _ := status.FromError(err)
-			errs = append(errs, fmt.Sprintf("tag=%s code=%s err=%v", tag, st.Code(), err))
+			errs = append(errs, TagError{Tag: tags[i], Err: err})
 		}
 	}
 	if len(errs) > 0 {
-		return fmt.Errorf(strings.Join(errs, "; "))
+		return errs
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// alter 在 tag 上执行一次 AlterInbound：先按 Throttle 排队，排到后才开始计单次超时
+func (c *Client) alter(tag string, op *serial.TypedMessage) error {
+	if c.Throttle != nil {
+		if err := c.Throttle(c.parent()); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.parent(), c.Timeout)
+	defer cancel()
+	_, err := c.API.AlterInbound(ctx, &command.AlterInboundRequest{
+		Tag:       tag,
+		Operation: op,
+	})
+	return err
+}
@@ -0,0 +1,186 @@
+package xray_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zionnode/xray-admin/internal/xray"
+	"github.com/zionnode/xray-admin/internal/xray/xraytest"
+
+	"golang.org/x/time/rate"
+)
+
+const testID = "11111111-1111-1111-1111-111111111111"
+
+// newTestClient 启动带 tags 的 fake Xray，返回作用于这些 tag 的 Client
+func newTestClient(t *testing.T, tags ...string) (*xray.Client, *xraytest.Server) {
+	t.Helper()
+	srv, err := xraytest.Start(tags...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := srv.Pool()
+	cli, err := pool.Client(xraytest.Addr, tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cli.Close()
+		pool.Close()
+		srv.Close()
+	})
+	return cli, srv
+}
+
+// failedTags 返回 TagErrors 里失败的 tag
+func failedTags(t *testing.T, err error) []string {
+	t.Helper()
+	var te xray.TagErrors
+	if !errors.As(err, &te) {
+		t.Fatalf("err = %v (%T), want TagErrors", err, err)
+	}
+	var out []string
+	for _, e := range te {
+		out = append(out, e.Tag)
+	}
+	return out
+}
+
+func TestAddAlreadyExists(t *testing.T) {
+	cli, srv := newTestClient(t, "a", "b")
+	if err := cli.AddVLESS("u@x", testID, 0, "", ""); err != nil {
+		t.Fatalf("first add: %v", err)
+	}
+	err := cli.AddVLESS("u@x", testID, 0, "", "")
+	if got := failedTags(t, err); len(got) != 2 {
+		t.Fatalf("failed tags = %v, want both", got)
+	}
+	for _, te := range err.(xray.TagErrors) {
+		if !strings.Contains(te.Err.Error(), "already exists") {
+			t.Errorf("tag %s: err = %v, want already exists", te.Tag, te.Err)
+		}
+	}
+
+	// AtomicAdd：失败的 tag 全是“已存在”时不撤回（用户本来就齐全）
+	cli.AtomicAdd = true
+	_ = cli.AddVLESS("u@x", testID, 0, "", "")
+	for _, tag := range []string{"a", "b"} {
+		if got := srv.Users(tag); len(got) != 1 || got[0] != "u@x" {
+			t.Errorf("users(%s) = %v, want [u@x]", tag, got)
+		}
+	}
+	for _, op := range srv.Ops() {
+		if op.Type == "remove" {
+			t.Errorf("unexpected rollback %+v", op)
+		}
+	}
+}
+
+func TestMultiTagFanOut(t *testing.T) {
+	tags := []string{"a", "b", "c"}
+	cli, srv := newTestClient(t, tags...)
+	if err := cli.AddVMess("u@x", testID, 1, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	adds := map[string]int{}
+	for _, op := range srv.Ops() {
+		if op.Type == "add" && op.Email == "u@x" {
+			adds[op.Tag]++
+		}
+	}
+	for _, tag := range tags {
+		if adds[tag] != 1 {
+			t.Errorf("adds on %s = %d, want 1", tag, adds[tag])
+		}
+	}
+
+	// 部分 tag 失败：只返回失败的 tag，其余 tag 照常成功
+	srv.Fail = func(op, tag, email string) error {
+		if tag == "b" {
+			return errors.New("boom")
+		}
+		return nil
+	}
+	err := cli.AddVMess("v@x", testID, 1, 0, "")
+	if got := failedTags(t, err); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("failed tags = %v, want [b]", got)
+	}
+	for _, tag := range []string{"a", "c"} {
+		if got := srv.Users(tag); len(got) != 2 {
+			t.Errorf("users(%s) = %v, want u@x and v@x", tag, got)
+		}
+	}
+
+	// AtomicAdd：真正失败时从已成功的 tag 撤回
+	cli.AtomicAdd = true
+	_ = cli.AddVMess("w@x", testID, 1, 0, "")
+	for _, tag := range tags {
+		for _, e := range srv.Users(tag) {
+			if e == "w@x" {
+				t.Errorf("w@x left on %s after rollback", tag)
+			}
+		}
+	}
+
+	// RemoveFromTags 只作用于给出的 tag；IgnoreNotFound 时不存在的 tag 算成功
+	srv.Fail = nil
+	cli.IgnoreNotFound = true
+	if err := cli.RemoveFromTags("v@x", []string{"a", "b"}); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if got := srv.Users("c"); len(got) != 2 {
+		t.Errorf("users(c) = %v, want untouched", got)
+	}
+}
+
+// 限速排队不占用单次调用的超时：低速率下排在后面的 tag 也不会 DeadlineExceeded
+func TestThrottleWaitOutsideTimeout(t *testing.T) {
+	tags := []string{"a", "b", "c"}
+	cli, srv := newTestClient(t, tags...)
+	cli.Timeout = 100 * time.Millisecond
+	cli.TagConcurrency = len(tags)
+	cli.Throttle = rate.NewLimiter(5, 1).Wait // 每 200ms 一次：最后一个 tag 要排 400ms
+
+	if err := cli.AddVLESS("u@x", testID, 0, "", ""); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	errs := cli.RemoveBatch([]string{"u@x"})
+	if errs[0] != nil {
+		t.Fatalf("remove batch: %v", errs[0])
+	}
+	for _, tag := range tags {
+		if got := srv.Users(tag); len(got) != 0 {
+			t.Errorf("users(%s) = %v, want empty", tag, got)
+		}
+	}
+}
+
+// Context 取消后排队中的调用立即返回，且不再发往 Xray
+func TestThrottleHonorsContext(t *testing.T) {
+	tags := []string{"a", "b", "c"}
+	cli, srv := newTestClient(t, tags...)
+	cli.Throttle = rate.NewLimiter(0.5, 1).Wait // 每 2s 一次
+	ctx, cancel := context.WithCancel(context.Background())
+	cli.Context = ctx
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := cli.AddVLESS("u@x", testID, 0, "", "")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("add took %s after cancel; throttle ignores ctx", elapsed)
+	}
+	if got := failedTags(t, err); len(got) != 2 {
+		t.Fatalf("failed tags = %v, want the two still queued", got)
+	}
+	for _, te := range err.(xray.TagErrors) {
+		if !errors.Is(te.Err, context.Canceled) {
+			t.Errorf("tag %s: err = %v, want context.Canceled", te.Tag, te.Err)
+		}
+	}
+	if ops := srv.Ops(); len(ops) != 1 {
+		t.Errorf("server saw %d ops, want only the first", len(ops))
+	}
+}
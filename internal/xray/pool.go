@@ -0,0 +1,65 @@
+package xray
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// Pool 按地址缓存 gRPC 连接，供常驻进程跨轮复用，省掉每轮的 Dial(WithBlock) 握手。
+// 连接断开后由 gRPC 自动重连；已被关闭（Shutdown）的连接会在下次 Client 时重新拨号。
+type Pool struct {
+	Timeout time.Duration // 拨号超时，也是取出的 Client 的单次 RPC 超时
+
+	// Dialer 非 nil 时用它建立底层连接（addr 原样传入），如测试里的 bufconn；为 nil 时按地址拨 TCP/unix
+	Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+	// Options 是拨号时附加的 gRPC 连接参数（只影响之后新拨的连接）
+	Options DialOptions
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+// NewPool 创建空连接池
+func NewPool(timeout time.Duration) *Pool {
+	return &Pool{Timeout: timeout, conns: make(map[string]*grpc.ClientConn)}
+}
+
+// Client 返回一个使用 addr 共享连接的新 Client（各字段独立，可按本次调用随意设置）。
+// 返回的 Client 的 Close 不会关闭共享连接；连接由 Pool.Close 统一关闭。
+func (p *Pool) Client(addr string, tags []string) (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn := p.conns[addr]
+	if conn != nil && conn.GetState() == connectivity.Shutdown {
+		conn = nil
+	}
+	if conn == nil {
+		var err error
+		if conn, err = dial(addr, p.Timeout, p.Dialer, p.Options); err != nil {
+			return nil, err
+		}
+		p.conns[addr] = conn
+	}
+	c := newClient(conn, tags, p.Timeout)
+	c.shared = true
+	return c, nil
+}
+
+// Close 关闭池中所有连接
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for addr, conn := range p.conns {
+		errs = append(errs, conn.Close())
+		delete(p.conns, addr)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,142 @@
+// Package xraytest 提供一个内存版的 Xray HandlerService，供测试使用：
+// 服务跑在 bufconn 上（不占端口），通过 Server.Pool 取得连向它的 xray.Pool（可直接放进 SyncOptions.Pool）。
+package xraytest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/app/proxyman/command"
+	"github.com/zionnode/xray-admin/internal/xray"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Op 是服务端收到的一次用户操作
+type Op struct {
+	Type  string // add | remove
+	Tag   string
+	Email string
+	Err   error // 服务端返回的错误（nil 表示成功）
+}
+
+// Server 是内存版 HandlerService：每个 tag 一个 email → 账号 的集合。
+// 错误文案与 Xray v1.8 一致（tag 不存在 / already exists / not found），便于复现客户端的幂等判断。
+type Server struct {
+	command.UnimplementedHandlerServiceServer
+
+	// Fail 非 nil 时在每次操作前调用，返回非 nil 错误则直接以该错误响应（用于模拟瞬时故障）
+	Fail func(op, tag, email string) error
+
+	lis  *bufconn.Listener
+	srv  *grpc.Server
+	mu   sync.Mutex
+	tags map[string]map[string]*command.AddUserOperation
+	ops  []Op
+}
+
+// Addr 是 Server 对外的地址名（只用作 xray.Pool 的键与日志，连接总是经由 Dial）
+const Addr = "xraytest"
+
+// Start 在内存连接（bufconn）上启动服务，tags 是预先存在的 inbound
+func Start(tags ...string) (*Server, error) {
+	lis := bufconn.Listen(1 << 20)
+	s := &Server{lis: lis, srv: grpc.NewServer(), tags: make(map[string]map[string]*command.AddUserOperation)}
+	for _, t := range tags {
+		s.tags[t] = make(map[string]*command.AddUserOperation)
+	}
+	command.RegisterHandlerServiceServer(s.srv, s)
+	go func() { _ = s.srv.Serve(lis) }()
+	return s, nil
+}
+
+// Dial 建立一条连向服务的内存连接（签名与 xray.Pool.Dialer 一致，addr 被忽略）
+func (s *Server) Dial(ctx context.Context, _ string) (net.Conn, error) {
+	return s.lis.DialContext(ctx)
+}
+
+// Pool 返回经由 Dial 连接本服务的 xray.Pool；地址用 Addr（多端点测试可用任意不同的名字）
+func (s *Server) Pool() *xray.Pool {
+	p := xray.NewPool(5 * time.Second)
+	p.Dialer = s.Dial
+	return p
+}
+
+// Close 停止服务
+func (s *Server) Close() { s.srv.Stop() }
+
+// Users 返回 tag 上当前的 email（已排序）
+func (s *Server) Users(tag string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for email := range s.tags[tag] {
+		out = append(out, email)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Ops 返回按到达顺序记录的全部操作
+func (s *Server) Ops() []Op {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Op(nil), s.ops...)
+}
+
+// AlterInbound 实现 command.HandlerServiceServer
+func (s *Server) AlterInbound(_ context.Context, req *command.AlterInboundRequest) (*command.AlterInboundResponse, error) {
+	raw, err := req.Operation.GetInstance()
+	if err != nil {
+		return nil, fmt.Errorf("unknown operation > %w", err)
+	}
+	var op Op
+	switch o := raw.(type) {
+	case *command.AddUserOperation:
+		op = Op{Type: "add", Tag: req.Tag, Email: o.GetUser().GetEmail()}
+	case *command.RemoveUserOperation:
+		op = Op{Type: "remove", Tag: req.Tag, Email: o.Email}
+	default:
+		return nil, fmt.Errorf("not an inbound operation")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op.Err = s.apply(op, raw)
+	s.ops = append(s.ops, op)
+	if op.Err != nil {
+		return nil, op.Err
+	}
+	return &command.AlterInboundResponse{}, nil
+}
+
+// apply 在持锁状态下执行一次操作
+func (s *Server) apply(op Op, raw any) error {
+	if s.Fail != nil {
+		if err := s.Fail(op.Type, op.Tag, op.Email); err != nil {
+			return err
+		}
+	}
+	users, ok := s.tags[op.Tag]
+	if !ok {
+		return fmt.Errorf("failed to get handler: %s > handler not found: %s", op.Tag, op.Tag)
+	}
+	switch op.Type {
+	case "add":
+		if _, dup := users[op.Email]; dup {
+			return fmt.Errorf("User %s already exists.", op.Email)
+		}
+		users[op.Email] = raw.(*command.AddUserOperation)
+	case "remove":
+		if _, found := users[op.Email]; !found {
+			return fmt.Errorf("User %s not found.", op.Email)
+		}
+		delete(users, op.Email)
+	}
+	return nil
+}